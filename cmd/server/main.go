@@ -12,7 +12,9 @@ import (
 	"github.com/google/uuid"
 
 	"voicechat/internal/auth"
+	"voicechat/internal/ice"
 	"voicechat/internal/store"
+	"voicechat/internal/turnserver"
 	"voicechat/internal/ws"
 
 	"github.com/gorilla/mux"
@@ -28,11 +30,33 @@ func main() {
 	// инициализация jwt-секрета
 	auth.Init()
 
+	// инициализация списка ICE-серверов (STUN/TURN) и секрета для TURN-учёток
+	ice.Init()
+
+	// встроенный TURN-сервер (опционально, VOICECHAT_TURN_EMBEDDED=true)
+	// запускается после ice.Init, т.к. регистрирует свой адрес в списке ICE-серверов для клиентов
+	turnSrv, err := turnserver.Start()
+	if err != nil {
+		log.Fatal("turn server:", err)
+	}
+	if turnSrv != nil {
+		defer turnSrv.Close()
+	}
+
+	// инициализация настроек сигналинга/WebRTC (trickle ICE, единый ICE порт и т.д.)
+	if err := ws.Init(); err != nil {
+		log.Fatal("ws init:", err)
+	}
+
 	// инициализация маршрутизатора
 	r := mux.NewRouter()
 
 	// регистрируем POST-эндпоинт для регистрации пользователя
 	r.HandleFunc("/api/register", func(w http.ResponseWriter, r *http.Request) {
+		// метрика: неуспех, пока не дошли до 201
+		created := false
+		defer func() { countAuth("register", created) }()
+
 		// декодируем JSON из тела запроса в локальную структуру
 		var req struct{ Username, Password string }
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -60,11 +84,16 @@ func main() {
 		}
 
 		// если все прошло успешно, возвращаем 201 Created
+		created = true
 		w.WriteHeader(http.StatusCreated)
 	}).Methods("POST")
 
 	// регистрируем POST-эндпоинт для входа пользователя
 	r.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+		// метрика: неуспех, пока не выдали токен
+		loggedIn := false
+		defer func() { countAuth("login", loggedIn) }()
+
 		// декодируем JSON с username и password из тела запроса в локальную структуру
 		var req struct{ Username, Password string }
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -84,26 +113,15 @@ func main() {
 			return
 		}
 		// возвращаем токен клиенту в JSON формате
+		loggedIn = true
 		_ = json.NewEncoder(w).Encode(map[string]string{"token": tok})
 	}).Methods("POST")
 
 	// регистрируем GET-эндпоинт для получения информации о текущем пользователе
 	r.HandleFunc("/api/me", func(w http.ResponseWriter, r *http.Request) {
-		// получаем заголовок Authorization из запроса
-		authz := r.Header.Get("Authorization")
-		if authz == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-		// извлекаем токен из формата "Bearer <token>"
-		var token string
-		if n, _ := fmt.Sscanf(authz, "Bearer %s", &token); n != 1 {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-		// валидируем и парсим JWT токен, получаем ID пользователя
-		uid, _, err := auth.ParseToken(token)
-		if err != nil {
+		// валидируем Bearer-токен и получаем ID пользователя
+		uid, ok := authenticate(r)
+		if !ok {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -117,6 +135,35 @@ func main() {
 		_ = json.NewEncoder(w).Encode(u)
 	}).Methods("GET")
 
+	// регистрируем GET-эндпоинт со списком ICE-серверов (STUN/TURN) для RTCPeerConnection клиента
+	// TURN-учётки временные и выписываются на конкретного пользователя (TURN REST API)
+	r.HandleFunc("/api/ice-servers", func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := authenticate(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// учётки нельзя кешировать дольше их жизни, проще не кешировать вовсе
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"iceServers": ice.ClientICEServers(uid),
+			"ttl":        int(ice.TTL().Seconds()),
+		})
+	}).Methods("GET")
+
+	// регистрируем REST API управления комнатами (/api/rooms...)
+	registerRoomRoutes(r)
+
+	// записи комнат: скачивание файлов (см. recordings.go)
+	registerRecordingRoutes(r)
+
+	// WHIP/WHEP: публикация звука в комнату и прослушивание сведения без WebSocket (см. whip.go)
+	registerWHIPRoutes(r)
+
+	// метрики Prometheus: на основном адресе или отдельном (VOICECHAT_METRICS_ADDR, см. metrics.go)
+	registerMetrics(r)
+
 	// регистрируем WebSocket эндпоинт
 	r.HandleFunc("/ws", ws.HandleWebSocket)
 	// регистрируем статические файлы (HTML, CSS, JS) из папки static для всех остальных маршрутов
@@ -129,3 +176,24 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// authenticate извлекает токен из заголовка "Authorization: Bearer <token>",
+// валидирует JWT и возвращает ID пользователя
+func authenticate(r *http.Request) (string, bool) {
+	// получаем заголовок Authorization из запроса
+	authz := r.Header.Get("Authorization")
+	if authz == "" {
+		return "", false
+	}
+	// извлекаем токен из формата "Bearer <token>"
+	var token string
+	if n, _ := fmt.Sscanf(authz, "Bearer %s", &token); n != 1 {
+		return "", false
+	}
+	// валидируем и парсим JWT токен, получаем ID пользователя
+	uid, _, err := auth.ParseToken(token)
+	if err != nil {
+		return "", false
+	}
+	return uid, true
+}
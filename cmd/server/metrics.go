@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registerMetrics отдаёт метрики Prometheus (GET /metrics, см. также internal/ws/metrics.go).
+// если задан VOICECHAT_METRICS_ADDR (например, "127.0.0.1:9090"), метрики слушают там
+// отдельным HTTP-сервером и не видны снаружи вместе с API; иначе — на основном роутере r
+func registerMetrics(r *mux.Router) {
+	addr := os.Getenv("VOICECHAT_METRICS_ADDR")
+	if addr == "" {
+		r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+		return
+	}
+	mr := mux.NewRouter()
+	mr.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	go func() {
+		log.Printf("Serving metrics on %s\n", addr)
+		if err := http.ListenAndServe(addr, mr); err != nil {
+			log.Fatal("metrics server:", err)
+		}
+	}()
+}
+
+// authAttempts — попытки входа и регистрации; op — login/register, result — success/failure
+var authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "voicechat_auth_attempts_total",
+	Help: "Login and register attempts, by operation and result.",
+}, []string{"op", "result"})
+
+// countAuth учитывает попытку op (login/register) с результатом ok
+func countAuth(op string, ok bool) {
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+	authAttempts.WithLabelValues(op, result).Inc()
+}
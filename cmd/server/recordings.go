@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"voicechat/internal/store"
+
+	"github.com/gorilla/mux"
+)
+
+// recordingView — запись в ответах REST API (без пути к файлу на сервере)
+type recordingView struct {
+	ID        string     `json:"id"`
+	RoomID    string     `json:"roomId"`
+	UserID    string     `json:"userId,omitempty"` // пусто для сведения комнаты
+	Kind      string     `json:"kind"`             // track — участник, mix — сведение комнаты
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+}
+
+func newRecordingView(rec store.Recording) recordingView {
+	return recordingView{
+		ID:        rec.ID,
+		RoomID:    rec.RoomID,
+		UserID:    rec.UserID,
+		Kind:      rec.Kind,
+		StartedAt: rec.StartedAt,
+		EndedAt:   rec.EndedAt,
+	}
+}
+
+// registerRecordingRoutes регистрирует скачивание записей комнат.
+// список записей комнаты — GET /api/rooms/{id}/recordings (см. rooms.go)
+func registerRecordingRoutes(r *mux.Router) {
+	// скачивание Ogg/Opus файла записи (владельцу и модераторам комнаты)
+	r.HandleFunc("/api/recordings/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authenticate(r); !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rec, err := store.GetRecording(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "recording lookup error", http.StatusInternalServerError)
+			return
+		}
+		if rec == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if !moderatesRoom(w, r, rec.RoomID) {
+			return
+		}
+		// пока запись идёт, файл не дописан (Ogg-страницы и заголовок WAV ещё меняются)
+		if rec.EndedAt == nil {
+			http.Error(w, "recording in progress", http.StatusConflict)
+			return
+		}
+		ext := filepath.Ext(rec.Path)
+		who := rec.UserID
+		if rec.Kind == store.RecordingMix {
+			who = "mix"
+		}
+		if ext == ".wav" {
+			w.Header().Set("Content-Type", "audio/wav")
+		} else {
+			w.Header().Set("Content-Type", "audio/ogg")
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": rec.RoomID + "-" + who + "-" + rec.ID + ext,
+		}))
+		http.ServeFile(w, r, rec.Path)
+	}).Methods("GET")
+}
+
+// removeRecordingFiles удаляет с диска файлы записей, строки которых уже удалены из БД.
+// файл идущей записи можно удалить сразу: писатель допишет и закроет уже отвязанный файл
+func removeRecordingFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("remove recording file:", err)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"voicechat/internal/store"
+	"voicechat/internal/ws"
+
+	"github.com/gorilla/mux"
+)
+
+// размер страницы истории чата: по умолчанию и максимальный
+const (
+	defaultMessagesPage = 50
+	maxMessagesPage     = 200
+)
+
+// roomView — комната в ответах REST API: настройки из БД и число участников онлайн
+type roomView struct {
+	ID           string    `json:"id"`
+	OwnerID      string    `json:"ownerId,omitempty"`
+	Visibility   string    `json:"visibility,omitempty"`
+	HasPassword  bool      `json:"hasPassword"`
+	LastN        int       `json:"lastN"` // размер пула слотов last-N, 0 — выключен
+	Participants int       `json:"participants"`
+	CreatedAt    time.Time `json:"createdAt,omitempty"`
+}
+
+func newRoomView(room *store.Room, participants int) roomView {
+	return roomView{
+		ID:           room.ID,
+		OwnerID:      room.OwnerID,
+		Visibility:   room.Visibility,
+		HasPassword:  room.PasswordHash != "",
+		LastN:        room.LastN,
+		Participants: participants,
+		CreatedAt:    room.CreatedAt,
+	}
+}
+
+// registerRoomRoutes регистрирует REST API управления комнатами.
+// все эндпоинты требуют Bearer-токен; изменять комнату может только её владелец.
+func registerRoomRoutes(r *mux.Router) {
+	// список активных комнат (в которых сейчас кто-то есть) с числом участников.
+	// публичные видны всем, остальные — только тем, кому доступна комната (см. roomAccess)
+	r.HandleFunc("/api/rooms", func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := authenticate(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// настройки активных комнат и доступ к ним — одним запросом к БД
+		active := ws.ListRooms()
+		ids := make([]string, 0, len(active))
+		participants := make(map[string]int, len(active))
+		for _, info := range active {
+			ids = append(ids, info.ID)
+			participants[info.ID] = info.Participants
+		}
+		listings, err := store.ListRooms(r.Context(), ids, uid)
+		if err != nil {
+			http.Error(w, "room lookup error", http.StatusInternalServerError)
+			return
+		}
+		// комнаты, которая есть в памяти, но не в БД (удалена и ещё закрывается), в listings нет
+		out := []roomView{}
+		for _, l := range listings {
+			if l.Visibility != store.RoomPublic && !listingAccess(&l, uid) {
+				continue
+			}
+			out = append(out, newRoomView(&l.Room, participants[l.ID]))
+		}
+		writeJSON(w, http.StatusOK, out)
+	}).Methods("GET")
+
+	// создание комнаты, вызывающий становится владельцем; lastN по умолчанию — VOICECHAT_LAST_N
+	r.HandleFunc("/api/rooms", func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := authenticate(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			ID         string `json:"id"`
+			Visibility string `json:"visibility"`
+			Password   string `json:"password"`
+			LastN      *int   `json:"lastN"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			http.Error(w, "invalid", http.StatusBadRequest)
+			return
+		}
+		if req.Visibility == "" {
+			req.Visibility = store.RoomPublic
+		}
+		if !store.ValidVisibility(req.Visibility) {
+			http.Error(w, "invalid visibility", http.StatusBadRequest)
+			return
+		}
+		lastN := ws.DefaultLastN()
+		if req.LastN != nil {
+			if !ws.ValidLastN(*req.LastN) {
+				http.Error(w, "invalid lastN", http.StatusBadRequest)
+				return
+			}
+			lastN = *req.LastN
+		}
+		room, err := store.CreateRoom(r.Context(), req.ID, uid, req.Visibility, req.Password, lastN)
+		if err != nil {
+			if errors.Is(err, store.ErrRoomExists) {
+				http.Error(w, "room already exists", http.StatusConflict)
+				return
+			}
+			http.Error(w, "create room error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, newRoomView(room, 0))
+	}).Methods("POST")
+
+	// изменение настроек комнаты: видимость, пароль ("" снимает пароль) и lastN; отсутствие поля — не меняет.
+	// новый lastN действует со следующего создания комнаты в памяти — когда все выйдут и кто-то войдёт снова
+	r.HandleFunc("/api/rooms/{id}", func(w http.ResponseWriter, r *http.Request) {
+		room, ok := ownedRoom(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Visibility *string `json:"visibility"`
+			Password   *string `json:"password"`
+			LastN      *int    `json:"lastN"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid", http.StatusBadRequest)
+			return
+		}
+		visibility := room.Visibility
+		if req.Visibility != nil {
+			if !store.ValidVisibility(*req.Visibility) {
+				http.Error(w, "invalid visibility", http.StatusBadRequest)
+				return
+			}
+			visibility = *req.Visibility
+		}
+		lastN := room.LastN
+		if req.LastN != nil {
+			if !ws.ValidLastN(*req.LastN) {
+				http.Error(w, "invalid lastN", http.StatusBadRequest)
+				return
+			}
+			lastN = *req.LastN
+		}
+		if _, err := store.UpdateRoom(r.Context(), room.ID, visibility, lastN, req.Password); err != nil {
+			http.Error(w, "update room error", http.StatusInternalServerError)
+			return
+		}
+		updated, err := store.GetRoom(r.Context(), room.ID)
+		if err != nil || updated == nil {
+			http.Error(w, "room lookup error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, newRoomView(updated, participantCount(room.ID)))
+	}).Methods("PATCH")
+
+	// удаление комнаты: всех участников отключаем, комнату удаляем из БД вместе с файлами записей
+	r.HandleFunc("/api/rooms/{id}", func(w http.ResponseWriter, r *http.Request) {
+		room, ok := ownedRoom(w, r)
+		if !ok {
+			return
+		}
+		_, paths, err := store.DeleteRoom(r.Context(), room.ID)
+		if err != nil {
+			http.Error(w, "delete room error", http.StatusInternalServerError)
+			return
+		}
+		if active := ws.LookupRoom(room.ID); active != nil {
+			active.Close()
+		}
+		removeRecordingFiles(paths)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	// участники комнаты, которые сейчас онлайн; права те же, что на историю чата (см. readsRoom)
+	r.HandleFunc("/api/rooms/{id}/participants", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !readsRoom(w, r, id) {
+			return
+		}
+		out := []ws.Participant{}
+		if active := ws.LookupRoom(id); active != nil {
+			out = active.Participants()
+		}
+		writeJSON(w, http.StatusOK, out)
+	}).Methods("GET")
+
+	// статистика соединений участников онлайн (ICE-пара, RTT, потери, джиттер, битрейт, кодек).
+	// для диагностики звонков, доступна владельцу и модераторам комнаты
+	r.HandleFunc("/api/rooms/{id}/stats", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !moderatesRoom(w, r, id) {
+			return
+		}
+		active := ws.LookupRoom(id)
+		if active == nil {
+			writeJSON(w, http.StatusOK, ws.RoomStats{Room: id, Participants: []ws.ParticipantStats{}})
+			return
+		}
+		writeJSON(w, http.StatusOK, active.Stats())
+	}).Methods("GET")
+
+	// записи комнаты (владельцу и модераторам), новые первыми
+	r.HandleFunc("/api/rooms/{id}/recordings", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !moderatesRoom(w, r, id) {
+			return
+		}
+		recs, err := store.ListRecordings(r.Context(), id)
+		if err != nil {
+			http.Error(w, "recordings lookup error", http.StatusInternalServerError)
+			return
+		}
+		out := make([]recordingView, 0, len(recs))
+		for _, rec := range recs {
+			out = append(out, newRecordingView(rec))
+		}
+		writeJSON(w, http.StatusOK, out)
+	}).Methods("GET")
+
+	// история чата комнаты постранично: ?before=<id>&limit=<n>, от старых к новым.
+	// следующая (более старая) страница — before=id первого сообщения
+	r.HandleFunc("/api/rooms/{id}/messages", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !readsRoom(w, r, id) {
+			return
+		}
+		q := r.URL.Query()
+		var before int64
+		if v := q.Get("before"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid before", http.StatusBadRequest)
+				return
+			}
+			before = n
+		}
+		limit := defaultMessagesPage
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxMessagesPage)
+		}
+		msgs, err := store.ListMessages(r.Context(), id, before, limit)
+		if err != nil {
+			http.Error(w, "messages lookup error", http.StatusInternalServerError)
+			return
+		}
+		out := make([]ws.ChatMessage, 0, len(msgs))
+		for _, m := range msgs {
+			out = append(out, ws.NewChatMessage(m))
+		}
+		writeJSON(w, http.StatusOK, out)
+	}).Methods("GET")
+
+	// приглашение пользователя в комнату (нужно для private/invite-only)
+	r.HandleFunc("/api/rooms/{id}/members", func(w http.ResponseWriter, r *http.Request) {
+		room, ok := ownedRoom(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+			http.Error(w, "invalid", http.StatusBadRequest)
+			return
+		}
+		u, err := store.GetUserByUsername(r.Context(), req.Username)
+		if err != nil {
+			http.Error(w, "user lookup error", http.StatusInternalServerError)
+			return
+		}
+		if u == nil {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		if err := store.AddRoomMember(r.Context(), room.ID, u.ID); err != nil {
+			http.Error(w, "add member error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
+
+	// исключение пользователя из участников комнаты
+	r.HandleFunc("/api/rooms/{id}/members/{userId}", func(w http.ResponseWriter, r *http.Request) {
+		room, ok := ownedRoom(w, r)
+		if !ok {
+			return
+		}
+		if err := store.RemoveRoomMember(r.Context(), room.ID, mux.Vars(r)["userId"]); err != nil {
+			http.Error(w, "remove member error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	// назначение модератора комнаты (только владелец)
+	r.HandleFunc("/api/rooms/{id}/moderators", func(w http.ResponseWriter, r *http.Request) {
+		room, ok := ownedRoom(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+			http.Error(w, "invalid", http.StatusBadRequest)
+			return
+		}
+		u, err := store.GetUserByUsername(r.Context(), req.Username)
+		if err != nil {
+			http.Error(w, "user lookup error", http.StatusInternalServerError)
+			return
+		}
+		if u == nil {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		if err := store.SetRoomRole(r.Context(), room.ID, u.ID, store.RoleModerator); err != nil {
+			http.Error(w, "set role error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
+
+	// снятие роли модератора (участник остаётся участником)
+	r.HandleFunc("/api/rooms/{id}/moderators/{userId}", func(w http.ResponseWriter, r *http.Request) {
+		room, ok := ownedRoom(w, r)
+		if !ok {
+			return
+		}
+		ok, err := store.DemoteModerator(r.Context(), room.ID, mux.Vars(r)["userId"])
+		if err != nil {
+			http.Error(w, "set role error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "moderator not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	// снятие бана (банят модераторы через сигналинг, см. ws/moderation.go)
+	r.HandleFunc("/api/rooms/{id}/bans/{userId}", func(w http.ResponseWriter, r *http.Request) {
+		room, ok := ownedRoom(w, r)
+		if !ok {
+			return
+		}
+		if err := store.UnbanUser(r.Context(), room.ID, mux.Vars(r)["userId"]); err != nil {
+			http.Error(w, "unban error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+}
+
+// ownedRoom проверяет токен и то, что вызывающий — владелец комнаты {id}.
+// при ошибке сам пишет ответ (401/404/403/500) и возвращает false.
+func ownedRoom(w http.ResponseWriter, r *http.Request) (*store.Room, bool) {
+	uid, ok := authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	room, err := store.GetRoom(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "room lookup error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if room == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return nil, false
+	}
+	if room.OwnerID != uid {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return room, true
+}
+
+// moderatesRoom проверяет токен и то, что вызывающий — владелец или модератор комнаты roomID.
+// при ошибке сам пишет ответ (401/403/500) и возвращает false.
+func moderatesRoom(w http.ResponseWriter, r *http.Request, roomID string) bool {
+	uid, ok := authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	allowed, err := store.IsRoomModerator(r.Context(), roomID, uid)
+	if err != nil {
+		http.Error(w, "room lookup error", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// readsRoom проверяет токен и то, что вызывающему доступна комната roomID (см. roomAccess):
+// её история чата и список участников.
+// при ошибке сам пишет ответ (401/403/404/500) и возвращает false.
+func readsRoom(w http.ResponseWriter, r *http.Request, roomID string) bool {
+	uid, ok := authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	room, err := store.GetRoom(r.Context(), roomID)
+	if err != nil {
+		http.Error(w, "room lookup error", http.StatusInternalServerError)
+		return false
+	}
+	if room == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return false
+	}
+	allowed, err := roomAccess(r, room, uid)
+	if err != nil {
+		http.Error(w, "room lookup error", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// roomAccess сообщает, доступна ли комната room пользователю uid — по тем же правилам,
+// что и вход без пароля (см. ws.authorizeJoin): владелец, участник или модератор,
+// кто угодно в публичной комнате без пароля, а также тот, кто сейчас в комнате онлайн.
+// забаненным комната недоступна.
+func roomAccess(r *http.Request, room *store.Room, uid string) (bool, error) {
+	banned, err := store.IsBanned(r.Context(), room.ID, uid)
+	if err != nil || banned {
+		return false, err
+	}
+	if room.OwnerID == uid || (room.Visibility == store.RoomPublic && room.PasswordHash == "") {
+		return true, nil
+	}
+	if active := ws.LookupRoom(room.ID); active != nil && active.HasUser(uid) {
+		return true, nil
+	}
+	return store.IsRoomMember(r.Context(), room.ID, uid)
+}
+
+// listingAccess — roomAccess для комнаты из списка: бан и членство уже получены запросом ListRooms
+func listingAccess(l *store.RoomListing, uid string) bool {
+	if l.Banned {
+		return false
+	}
+	if l.OwnerID == uid || l.Member || (l.Visibility == store.RoomPublic && l.PasswordHash == "") {
+		return true
+	}
+	active := ws.LookupRoom(l.ID)
+	return active != nil && active.HasUser(uid)
+}
+
+// participantCount возвращает число участников онлайн в комнате
+func participantCount(id string) int {
+	if active := ws.LookupRoom(id); active != nil {
+		return len(active.Participants())
+	}
+	return 0
+}
+
+// writeJSON отдаёт v в JSON с заданным статусом
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
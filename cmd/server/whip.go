@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"voicechat/internal/ice"
+	"voicechat/internal/ws"
+
+	"github.com/gorilla/mux"
+)
+
+// maxSDPSize — ограничение на размер offer и trickle-фрагмента в теле запроса
+const maxSDPSize = 64 << 10
+
+// registerWHIPRoutes регистрирует WHIP (публикация звука в комнату) и WHEP (прослушивание сведения комнаты).
+// клиент авторизуется тем же Bearer-токеном, что и REST API; сама сессия живёт в ws (см. ws/whip.go):
+//   - POST /whip/{room}, POST /whep/{room} — offer (application/sdp) → 201, answer и Location сессии
+//   - PATCH <Location> — trickle ICE (application/trickle-ice-sdpfrag) → 204
+//   - DELETE <Location> — завершить сессию → 200
+func registerWHIPRoutes(r *mux.Router) {
+	r.HandleFunc("/whip/{room}", func(w http.ResponseWriter, r *http.Request) {
+		startSession(w, r, "/whip/", ws.StartWHIP)
+	}).Methods("POST")
+	r.HandleFunc("/whep/{room}", func(w http.ResponseWriter, r *http.Request) {
+		startSession(w, r, "/whep/", ws.StartWHEP)
+	}).Methods("POST")
+
+	for _, prefix := range []string{"/whip/", "/whep/"} {
+		r.HandleFunc(prefix+"{room}/{session}", patchSession).Methods("PATCH")
+		r.HandleFunc(prefix+"{room}/{session}", deleteSession).Methods("DELETE")
+	}
+}
+
+// startSession принимает offer клиента и отвечает answer'ом созданной сессии
+func startSession(w http.ResponseWriter, r *http.Request, prefix string,
+	start func(ctx context.Context, roomID, userID, offerSDP string) (string, string, error)) {
+	uid, ok := authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	offer, ok := readBody(w, r, "application/sdp")
+	if !ok {
+		return
+	}
+	room := mux.Vars(r)["room"]
+	id, answer, err := start(r.Context(), room, uid, offer)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	// STUN/TURN для клиента — в Link-заголовках (RFC 9725, раздел 4.6)
+	for _, s := range ice.ClientICEServers(uid) {
+		for _, u := range s.URLs {
+			link := "<" + u + `>; rel="ice-server"`
+			if s.Username != "" {
+				link += fmt.Sprintf(`; username=%q; credential=%q; credential-type="password"`, s.Username, fmt.Sprint(s.Credential))
+			}
+			w.Header().Add("Link", link)
+		}
+	}
+	w.Header().Set("Location", prefix+room+"/"+id)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = io.WriteString(w, answer)
+}
+
+// patchSession добавляет ICE-кандидатов клиента к сессии
+func patchSession(w http.ResponseWriter, r *http.Request) {
+	uid, ok := authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	frag, ok := readBody(w, r, "application/trickle-ice-sdpfrag")
+	if !ok {
+		return
+	}
+	if err := ws.TrickleSession(mux.Vars(r)["session"], uid, frag); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteSession завершает сессию: участник уходит из комнаты
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	uid, ok := authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := ws.EndSession(mux.Vars(r)["session"], uid); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// readBody проверяет Content-Type и читает тело запроса (не больше maxSDPSize).
+// при ошибке сам пишет ответ (415/400/413) и возвращает false
+func readBody(w http.ResponseWriter, r *http.Request, contentType string) (string, bool) {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != contentType {
+		http.Error(w, "content type must be "+contentType, http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSDPSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "body too large, max "+strconv.Itoa(maxSDPSize)+" bytes", http.StatusRequestEntityTooLarge)
+			return "", false
+		}
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return "", false
+	}
+	if len(body) == 0 {
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return "", false
+	}
+	return string(body), true
+}
+
+// writeSessionError переводит ошибку WHIP/WHEP-сессии в HTTP-ответ
+func writeSessionError(w http.ResponseWriter, err error) {
+	var pe *ws.ProtocolError
+	switch {
+	case errors.As(err, &pe):
+		if pe.Code == ws.CodeInternal {
+			http.Error(w, pe.Message, http.StatusInternalServerError)
+			return
+		}
+		// room_forbidden, room_banned, room_password_required
+		http.Error(w, pe.Code, http.StatusForbidden)
+	case errors.Is(err, ws.ErrUnknownUser):
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	case errors.Is(err, ws.ErrAlreadyJoined):
+		http.Error(w, "already in room", http.StatusConflict)
+	case errors.Is(err, ws.ErrInvalidOffer):
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+	case errors.Is(err, ws.ErrSessionNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, ws.ErrMixUnavailable):
+		// сервер собран без Opus — сведения для WHEP нет
+		http.Error(w, "mixing not available", http.StatusNotImplemented)
+	case errors.Is(err, ws.ErrICERestartUnsupported):
+		// RFC 9725: PATCH, который ресурс не поддерживает (здесь ICE restart), отклоняется с 422
+		http.Error(w, "ice restart not supported", http.StatusUnprocessableEntity)
+	default:
+		log.Println("whip/whep session:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,141 @@
+package ice
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// defaultSTUN используется, если VOICECHAT_STUN_URLS не задан
+const defaultSTUN = "stun:stun.l.google.com:19302"
+
+var (
+	// stunURLs — публичные STUN-серверы, отдаются и клиентам, и серверному PeerConnection
+	stunURLs []string
+	// turnURLs — TURN-серверы (например, coturn), отдаются только клиентам
+	turnURLs []string
+	// turnSecret — общий секрет с TURN-сервером (coturn: static-auth-secret / use-auth-secret)
+	turnSecret []byte
+	// turnTTL — время жизни выдаваемых TURN-учёток
+	turnTTL = 12 * time.Hour
+)
+
+// Init читает настройки ICE-серверов из переменных окружения:
+//   - VOICECHAT_STUN_URLS — STUN URL через запятую (по умолчанию stun.l.google.com)
+//   - VOICECHAT_TURN_URLS — TURN URL через запятую, например "turn:turn.example.com:3478?transport=udp"
+//   - VOICECHAT_TURN_SECRET — общий секрет для временных учёток по TURN REST API
+//   - VOICECHAT_TURN_TTL — время жизни учётки (Go duration, по умолчанию 12h)
+func Init() {
+	stunURLs = splitList(os.Getenv("VOICECHAT_STUN_URLS"))
+	if len(stunURLs) == 0 {
+		stunURLs = []string{defaultSTUN}
+	}
+	turnURLs = splitList(os.Getenv("VOICECHAT_TURN_URLS"))
+	turnSecret = []byte(os.Getenv("VOICECHAT_TURN_SECRET"))
+
+	if v := os.Getenv("VOICECHAT_TURN_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("invalid VOICECHAT_TURN_TTL=%q, using %s\n", v, turnTTL)
+		} else {
+			turnTTL = d
+		}
+	}
+	// TURN без секрета бесполезен: coturn с use-auth-secret отклонит любые учётки
+	if len(turnURLs) > 0 && len(turnSecret) == 0 {
+		log.Println("VOICECHAT_TURN_URLS set without VOICECHAT_TURN_SECRET: TURN servers disabled")
+		turnURLs = nil
+	}
+}
+
+// TTL возвращает время жизни TURN-учёток, выдаваемых клиентам
+func TTL() time.Duration {
+	return turnTTL
+}
+
+// ServerICEServers возвращает ICE-серверы для серверного PeerConnection.
+// серверу достаточно STUN, чтобы узнать свой публичный адрес; relay через TURN
+// на стороне SFU только удвоил бы путь пакетов.
+func ServerICEServers() []webrtc.ICEServer {
+	return []webrtc.ICEServer{{URLs: stunURLs}}
+}
+
+// ClientICEServers возвращает ICE-серверы для клиента userID:
+// STUN как есть и TURN с временной учёткой, выписанной на этого пользователя.
+func ClientICEServers(userID string) []webrtc.ICEServer {
+	servers := []webrtc.ICEServer{{URLs: stunURLs}}
+	if len(turnURLs) > 0 {
+		username, credential := TURNCredentials(userID, time.Now().Add(turnTTL))
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       turnURLs,
+			Username:   username,
+			Credential: credential,
+		})
+	}
+	return servers
+}
+
+// TURNCredentials выписывает временную учётку по TURN REST API
+// (draft-uberti-behave-turn-rest, поддерживается coturn через use-auth-secret):
+// username = "<unix-время истечения>:<userID>",
+// credential = base64(HMAC-SHA1(secret, username)).
+// TURN-сервер сам пересчитывает HMAC и проверяет, что время истечения ещё не наступило.
+func TURNCredentials(userID string, expiry time.Time) (username, credential string) {
+	username = strconv.FormatInt(expiry.Unix(), 10) + ":" + userID
+	mac := hmac.New(sha1.New, turnSecret)
+	mac.Write([]byte(username))
+	credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return username, credential
+}
+
+// VerifyTURNUsername проверяет username временной TURN-учётки ("<expiry>:<userID>"):
+// формат и то, что срок ещё не истёк. возвращает userID и пароль, который должен был
+// выписать TURNCredentials — по нему TURN-сервер проверяет MESSAGE-INTEGRITY.
+func VerifyTURNUsername(username string) (userID, password string, ok bool) {
+	ts, userID, found := strings.Cut(username, ":")
+	if !found || userID == "" {
+		return "", "", false
+	}
+	exp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "", "", false
+	}
+	_, password = TURNCredentials(userID, time.Unix(exp, 0))
+	return userID, password, true
+}
+
+// UseEmbeddedTURN включает выдачу клиентам встроенного TURN-сервера.
+// URL из VOICECHAT_TURN_URLS имеют приоритет; если секрет не задан,
+// генерируется случайный — он нужен только этому процессу.
+func UseEmbeddedTURN(urls []string) {
+	if len(turnSecret) == 0 {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Println("generate TURN secret:", err)
+			return
+		}
+		turnSecret = secret
+	}
+	if len(turnURLs) == 0 {
+		turnURLs = urls
+	}
+}
+
+// splitList разбирает список через запятую, отбрасывая пустые элементы
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package ice
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTURNCredentials(t *testing.T) {
+	turnSecret = []byte("north")
+	defer func() { turnSecret = nil }()
+
+	expiry := time.Unix(1700000000, 0)
+	username, credential := TURNCredentials("42", expiry)
+	if want := "1700000000:42"; username != want {
+		t.Errorf("username = %q, want %q", username, want)
+	}
+	// то же, что считает coturn с use-auth-secret: base64(HMAC-SHA1(secret, username))
+	mac := hmac.New(sha1.New, []byte("north"))
+	mac.Write([]byte(username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); credential != want {
+		t.Errorf("credential = %q, want %q", credential, want)
+	}
+
+	turnSecret = []byte("south")
+	if _, other := TURNCredentials("42", expiry); other == credential {
+		t.Error("credential does not depend on the secret")
+	}
+}
+
+func TestVerifyTURNUsername(t *testing.T) {
+	turnSecret = []byte("north")
+	defer func() { turnSecret = nil }()
+
+	username, credential := TURNCredentials("42", time.Now().Add(time.Hour))
+	userID, password, ok := VerifyTURNUsername(username)
+	if !ok || userID != "42" || password != credential {
+		t.Errorf("VerifyTURNUsername(%q) = %q, %q, %v; want 42, %q, true", username, userID, password, ok, credential)
+	}
+
+	// id пользователя может содержать ":" — режется только первый
+	if userID, _, ok := VerifyTURNUsername(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + ":a:b"); !ok || userID != "a:b" {
+		t.Errorf("user id with colon = %q, %v; want a:b, true", userID, ok)
+	}
+
+	expired, _ := TURNCredentials("42", time.Now().Add(-time.Minute))
+	for _, bad := range []string{expired, "42", "soon:42", "1700000000:", ""} {
+		if _, _, ok := VerifyTURNUsername(bad); ok {
+			t.Errorf("VerifyTURNUsername(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package mixer
+
+import "errors"
+
+// Opus кодируется и декодируется libopus через cgo — только в сборке с тегом opus
+// (go build -tags opus, нужны заголовки и pkg-config libopus). без тега Available == false:
+// микшер не может декодировать источники, а NewEncoder и ogg-сведение возвращают ErrNoOpus.
+
+// ErrNoOpus — сервер собран без тега opus, сведение недоступно
+var ErrNoOpus = errors.New("mixer: built without opus support")
+
+// decoder — Opus-декодер одного источника (48 кГц, моно).
+// Decode с payload == nil маскирует потерянный кадр (PLC) длиной len(pcm)
+type decoder interface {
+	Decode(payload []byte, pcm []float32) (int, error)
+}
+
+// encoder — Opus-кодер кадров сведения: кодирует pcm в out и возвращает размер пакета
+type encoder interface {
+	Encode(pcm []float32, out []byte) (int, error)
+}
+
+// newDecoder и newEncoder создают кодеки сборки (opus.go или opus_stub.go); тесты подменяют newDecoder
+var (
+	newDecoder = newOpusDecoder
+	newEncoder = newOpusEncoder
+)
@@ -0,0 +1,229 @@
+// Package mixer декодирует Opus RTP нескольких участников, выравнивает их
+// через jitter buffer и сводит в один PCM-поток (48 кГц, моно, кадры по 20 мс).
+//
+// RTP timestamp выравнивается только внутри источника (потери, DTX). между источниками
+// общей шкалы нет: каждый начинает звучать, как только набрал свой jitter buffer, поэтому
+// в сведении остаётся разница сетевых задержек участников плюс до jitterPackets кадров.
+// сопоставление источников по NTP-времени из RTCP SR не реализовано.
+package mixer
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// SampleRate — частота сведения и выходных файлов
+	SampleRate = 48000
+	// FrameSamples — размер кадра сведения: 20 мс при 48 кГц
+	FrameSamples = SampleRate / 50
+
+	// jitterPackets — сколько пакетов источник копит перед началом воспроизведения
+	jitterPackets = 3
+	// maxBuffered — больше пакетов в буфере источника означает, что он ушёл далеко вперёд: буфер сбрасывается
+	maxBuffered = 50
+	// maxConcealed — сколько кадров подряд без пакетов маскируется PLC, прежде чем источник считается замолчавшим
+	maxConcealed = 10
+	// maxGapSamples — максимальная пауза по RTP timestamp (DTX), заполняемая тишиной
+	maxGapSamples = SampleRate
+	// maxDecodedSamples — максимум сэмплов в одном Opus-пакете (120 мс)
+	maxDecodedSamples = 5760
+)
+
+// Mixer сводит аудио нескольких источников. Push вызывается из циклов чтения RTP
+// (по горутине на источник), Mix — из одного тикера раз в 20 мс.
+type Mixer struct {
+	mtx     sync.Mutex
+	sources map[string]*source
+}
+
+// New создаёт пустой микшер
+func New() *Mixer {
+	return &Mixer{sources: make(map[string]*source)}
+}
+
+// Push добавляет Opus RTP-пакет источника id
+func (m *Mixer) Push(id string, pkt *rtp.Packet) {
+	m.mtx.Lock()
+	s := m.sources[id]
+	if s == nil {
+		var err error
+		if s, err = newSource(); err != nil {
+			m.mtx.Unlock()
+			return
+		}
+		m.sources[id] = s
+	}
+	m.mtx.Unlock()
+	s.push(pkt)
+}
+
+// Remove убирает источник (участник ушёл)
+func (m *Mixer) Remove(id string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.sources, id)
+}
+
+// Frame — один кадр сведения: сумма всех источников и вклад каждого из них
+type Frame struct {
+	Sum   []float32
+	Parts map[string][]float32 // только источники, звучавшие в этом кадре
+}
+
+// Without записывает в out сведение без источника id («mix-minus»: участник не слышит себя)
+func (f Frame) Without(id string, out []float32) {
+	copy(out, f.Sum)
+	if part, ok := f.Parts[id]; ok {
+		for i := range out {
+			out[i] -= part[i]
+		}
+	}
+}
+
+// Mix снимает со всех источников по 20 мс и возвращает кадр сведения
+func (m *Mixer) Mix() Frame {
+	m.mtx.Lock()
+	srcs := make(map[string]*source, len(m.sources))
+	for id, s := range m.sources {
+		srcs[id] = s
+	}
+	m.mtx.Unlock()
+
+	f := Frame{Sum: make([]float32, FrameSamples), Parts: make(map[string][]float32)}
+	for id, s := range srcs {
+		part := make([]float32, FrameSamples)
+		if !s.pull(part) {
+			continue
+		}
+		f.Parts[id] = part
+		for i, v := range part {
+			f.Sum[i] += v
+		}
+	}
+	return f
+}
+
+// source — jitter buffer и декодер одного участника
+type source struct {
+	mtx sync.Mutex
+	dec decoder
+
+	buf       map[uint16]*rtp.Packet // ожидающие пакеты по seq
+	playing   bool                   // буфер набран, идёт воспроизведение
+	nextSeq   uint16                 // следующий пакет к декодированию
+	nextTS    uint32                 // ожидаемый RTP timestamp следующего пакета
+	tsKnown   bool
+	concealed int // кадров подряд без пакетов
+
+	pcm     []float32 // декодированные, но ещё не сведённые сэмплы
+	scratch []float32
+}
+
+func newSource() (*source, error) {
+	dec, err := newDecoder()
+	if err != nil {
+		return nil, err
+	}
+	return &source{
+		dec:     dec,
+		buf:     make(map[uint16]*rtp.Packet),
+		scratch: make([]float32, maxDecodedSamples),
+	}, nil
+}
+
+// push кладёт пакет в jitter buffer. опоздавшие (seq уже проигран) отбрасываются
+func (s *source) push(pkt *rtp.Packet) {
+	if len(pkt.Payload) == 0 {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.playing && int16(pkt.SequenceNumber-s.nextSeq) < 0 {
+		return
+	}
+	if len(s.buf) >= maxBuffered {
+		// источник далеко впереди воспроизведения (например, после долгой паузы) — начинаем заново
+		s.reset()
+	}
+	p := *pkt
+	p.Payload = append([]byte(nil), pkt.Payload...)
+	s.buf[pkt.SequenceNumber] = &p
+}
+
+// reset сбрасывает воспроизведение: источник снова набирает jitter buffer
+func (s *source) reset() {
+	s.buf = make(map[uint16]*rtp.Packet)
+	s.playing, s.tsKnown = false, false
+	s.concealed = 0
+	s.pcm = s.pcm[:0]
+}
+
+// pull заполняет out следующими 20 мс источника. false — источнику нечего воспроизводить
+func (s *source) pull(out []float32) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.playing {
+		if len(s.buf) < jitterPackets {
+			return false
+		}
+		s.playing = true
+		s.nextSeq = s.oldestSeq()
+	}
+
+	for len(s.pcm) < len(out) {
+		pkt, ok := s.buf[s.nextSeq]
+		if !ok {
+			if len(s.buf) == 0 && s.concealed >= maxConcealed {
+				// пакетов давно нет — источник замолчал (ушёл, заглушён, DTX)
+				s.reset()
+				return false
+			}
+			// потеря или опоздание — маскируем кадр PLC и идём дальше
+			s.concealed++
+			s.nextSeq++
+			n, err := s.dec.Decode(nil, s.scratch[:FrameSamples])
+			if err != nil {
+				n = FrameSamples
+				clear(s.scratch[:n])
+			}
+			s.pcm = append(s.pcm, s.scratch[:n]...)
+			s.nextTS += uint32(n)
+			continue
+		}
+		delete(s.buf, s.nextSeq)
+		s.nextSeq++
+		s.concealed = 0
+
+		// разрыв по timestamp при подряд идущих seq — пауза отправителя (DTX): заполняем тишиной
+		if s.tsKnown {
+			if gap := int32(pkt.Timestamp - s.nextTS); gap > 0 && gap <= maxGapSamples {
+				s.pcm = append(s.pcm, make([]float32, gap)...)
+			}
+		}
+		n, err := s.dec.Decode(pkt.Payload, s.scratch)
+		if err != nil {
+			continue
+		}
+		s.pcm = append(s.pcm, s.scratch[:n]...)
+		s.nextTS, s.tsKnown = pkt.Timestamp+uint32(n), true
+	}
+
+	copy(out, s.pcm[:len(out)])
+	s.pcm = append(s.pcm[:0], s.pcm[len(out):]...)
+	return true
+}
+
+// oldestSeq возвращает наименьший (с учётом переполнения) seq в буфере
+func (s *source) oldestSeq() uint16 {
+	first := true
+	var oldest uint16
+	for seq := range s.buf {
+		if first || int16(seq-oldest) < 0 {
+			oldest, first = seq, false
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,196 @@
+package mixer
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// тесты проверяют jitter buffer и сведение без libopus: «пакет» несёт один байт уровня,
+// testDecoder разворачивает его в кадр из FrameSamples одинаковых сэмплов level/100
+func TestMain(m *testing.M) {
+	newDecoder = func() (decoder, error) { return testDecoder{}, nil }
+	os.Exit(m.Run())
+}
+
+type testDecoder struct{}
+
+func (testDecoder) Decode(payload []byte, pcm []float32) (int, error) {
+	var v float32
+	if payload != nil {
+		v = float32(int8(payload[0])) / 100
+	}
+	n := min(FrameSamples, len(pcm))
+	for i := range pcm[:n] {
+		pcm[i] = v
+	}
+	return n, nil
+}
+
+// tone возвращает n кадров по 20 мс уровня level/100 в RTP-пакетах с seq от firstSeq
+func tone(n int, level int8, firstSeq uint16) []*rtp.Packet {
+	pkts := make([]*rtp.Packet, n)
+	for i := range pkts {
+		pkts[i] = &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: firstSeq + uint16(i), Timestamp: uint32(i * FrameSamples)},
+			Payload: []byte{byte(level)},
+		}
+	}
+	return pkts
+}
+
+func rms(pcm []float32) float64 {
+	var sum float64
+	for _, v := range pcm {
+		sum += float64(v) * float64(v)
+	}
+	return math.Sqrt(sum / float64(len(pcm)))
+}
+
+func TestJitterBufferFillsBeforePlaying(t *testing.T) {
+	s, err := newSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkts := tone(jitterPackets, 50, 100)
+	out := make([]float32, FrameSamples)
+	for _, p := range pkts[:jitterPackets-1] {
+		s.push(p)
+		if s.pull(out) {
+			t.Fatalf("playing with %d packets buffered, want %d", len(s.buf), jitterPackets)
+		}
+	}
+	s.push(pkts[jitterPackets-1])
+	if !s.pull(out) {
+		t.Fatal("not playing with full jitter buffer")
+	}
+	if s.nextSeq != 101 {
+		t.Errorf("nextSeq = %d, want 101", s.nextSeq)
+	}
+}
+
+func TestJitterBufferReorderAndLate(t *testing.T) {
+	s, err := newSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkts := tone(6, 50, 65534) // seq переходит через 0
+	// пришли не по порядку: воспроизведение всё равно начинается с самого старого
+	for _, i := range []int{2, 0, 1} {
+		s.push(pkts[i])
+	}
+	out := make([]float32, FrameSamples)
+	if !s.pull(out) {
+		t.Fatal("not playing")
+	}
+	if s.nextSeq != pkts[1].SequenceNumber {
+		t.Fatalf("nextSeq = %d, want %d", s.nextSeq, pkts[1].SequenceNumber)
+	}
+	// опоздавший (уже проигранный) пакет отбрасывается
+	s.push(pkts[0])
+	if _, ok := s.buf[pkts[0].SequenceNumber]; ok {
+		t.Error("late packet buffered")
+	}
+	for i := 1; i < 3; i++ {
+		if !s.pull(out) {
+			t.Fatalf("frame %d: not playing", i)
+		}
+	}
+	if len(s.buf) != 0 {
+		t.Errorf("%d packets left in buffer", len(s.buf))
+	}
+}
+
+func TestJitterBufferConcealsThenStops(t *testing.T) {
+	s, err := newSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range tone(jitterPackets, 50, 0) {
+		s.push(p)
+	}
+	out := make([]float32, FrameSamples)
+	for i := 0; i < jitterPackets; i++ {
+		if !s.pull(out) {
+			t.Fatalf("frame %d: not playing", i)
+		}
+	}
+	// пакеты кончились: maxConcealed кадров маскируются PLC, затем источник замолкает
+	for i := 0; i < maxConcealed; i++ {
+		if !s.pull(out) {
+			t.Fatalf("concealed frame %d: not playing", i)
+		}
+	}
+	if s.pull(out) {
+		t.Error("still playing after maxConcealed lost frames")
+	}
+	if s.playing {
+		t.Error("source not reset after going silent")
+	}
+}
+
+func TestMixMinus(t *testing.T) {
+	m := New()
+	a := tone(10, 30, 0)
+	b := tone(10, -60, 500)
+	for i := 0; i < jitterPackets; i++ {
+		m.Push("a", a[i])
+		m.Push("b", b[i])
+	}
+
+	f := m.Mix()
+	if len(f.Parts) != 2 {
+		t.Fatalf("parts = %d, want 2", len(f.Parts))
+	}
+	for i, v := range f.Sum {
+		if d := v - f.Parts["a"][i] - f.Parts["b"][i]; math.Abs(float64(d)) > 1e-6 {
+			t.Fatalf("sum[%d] differs from parts by %v", i, d)
+		}
+	}
+
+	// «a» слышит только «b» и наоборот
+	out := make([]float32, FrameSamples)
+	f.Without("a", out)
+	for i := range out {
+		if math.Abs(float64(out[i]-f.Parts["b"][i])) > 1e-6 {
+			t.Fatalf("mix without a [%d] = %v, want b = %v", i, out[i], f.Parts["b"][i])
+		}
+	}
+	f.Without("b", out)
+	for i := range out {
+		if math.Abs(float64(out[i]-f.Parts["a"][i])) > 1e-6 {
+			t.Fatalf("mix without b [%d] = %v, want a = %v", i, out[i], f.Parts["a"][i])
+		}
+	}
+	// источник, не звучавший в кадре, слышит всё сведение
+	f.Without("c", out)
+	for i := range out {
+		if out[i] != f.Sum[i] {
+			t.Fatalf("mix without silent source differs from sum at %d", i)
+		}
+	}
+}
+
+func TestMixSkipsSilentSources(t *testing.T) {
+	m := New()
+	for _, p := range tone(jitterPackets, 30, 0) {
+		m.Push("a", p)
+	}
+	// у «b» jitter buffer ещё не набран
+	m.Push("b", tone(1, -60, 0)[0])
+
+	f := m.Mix()
+	if _, ok := f.Parts["b"]; ok {
+		t.Error("source with unfilled jitter buffer contributes to the mix")
+	}
+	if rms(f.Sum) == 0 {
+		t.Error("mix is silent with one playing source")
+	}
+
+	m.Remove("a")
+	if f := m.Mix(); len(f.Parts) != 0 {
+		t.Errorf("removed source still mixed: %d parts", len(f.Parts))
+	}
+}
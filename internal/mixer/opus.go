@@ -0,0 +1,75 @@
+//go:build opus
+
+package mixer
+
+// #cgo pkg-config: opus
+// #include <opus.h>
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"unsafe"
+)
+
+// Available сообщает, собран ли сервер с Opus (тег opus) и работает ли сведение
+const Available = true
+
+// opusError переводит код ошибки libopus в error
+func opusError(code C.int) error {
+	return errors.New("opus: " + C.GoString(C.opus_strerror(code)))
+}
+
+// opusDecoder — декодер libopus; освобождается вместе с источником (finalizer)
+type opusDecoder struct {
+	d *C.OpusDecoder
+}
+
+func newOpusDecoder() (decoder, error) {
+	var code C.int
+	d := C.opus_decoder_create(C.opus_int32(SampleRate), 1, &code)
+	if code != C.OPUS_OK {
+		return nil, opusError(code)
+	}
+	dec := &opusDecoder{d: d}
+	runtime.SetFinalizer(dec, func(dec *opusDecoder) { C.opus_decoder_destroy(dec.d) })
+	return dec, nil
+}
+
+func (dec *opusDecoder) Decode(payload []byte, pcm []float32) (int, error) {
+	var data *C.uchar
+	if len(payload) > 0 {
+		data = (*C.uchar)(unsafe.Pointer(&payload[0]))
+	}
+	n := C.opus_decode_float(dec.d, data, C.opus_int32(len(payload)),
+		(*C.float)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)), 0)
+	if n < 0 {
+		return 0, opusError(n)
+	}
+	return int(n), nil
+}
+
+// opusEncoder — кодер libopus в режиме VoIP; освобождается вместе с Encoder (finalizer)
+type opusEncoder struct {
+	e *C.OpusEncoder
+}
+
+func newOpusEncoder() (encoder, error) {
+	var code C.int
+	e := C.opus_encoder_create(C.opus_int32(SampleRate), 1, C.OPUS_APPLICATION_VOIP, &code)
+	if code != C.OPUS_OK {
+		return nil, opusError(code)
+	}
+	enc := &opusEncoder{e: e}
+	runtime.SetFinalizer(enc, func(enc *opusEncoder) { C.opus_encoder_destroy(enc.e) })
+	return enc, nil
+}
+
+func (enc *opusEncoder) Encode(pcm []float32, out []byte) (int, error) {
+	n := C.opus_encode_float(enc.e, (*C.float)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)),
+		(*C.uchar)(unsafe.Pointer(&out[0])), C.opus_int32(len(out)))
+	if n < 0 {
+		return 0, opusError(C.int(n))
+	}
+	return int(n), nil
+}
@@ -0,0 +1,14 @@
+//go:build !opus
+
+package mixer
+
+// Available сообщает, собран ли сервер с Opus (тег opus) и работает ли сведение
+const Available = false
+
+func newOpusDecoder() (decoder, error) {
+	return nil, ErrNoOpus
+}
+
+func newOpusEncoder() (encoder, error) {
+	return nil, ErrNoOpus
+}
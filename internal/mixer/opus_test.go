@@ -0,0 +1,48 @@
+//go:build opus
+
+package mixer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOpusRoundTrip(t *testing.T) {
+	enc, err := NewEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := newOpusDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := make([]float32, FrameSamples)
+	out := make([]float32, maxDecodedSamples)
+	var energy float64
+	for i := 0; i < 10; i++ {
+		for j := range pcm {
+			k := float64(i*FrameSamples + j)
+			pcm[j] = float32(0.5 * math.Sin(2*math.Pi*440*k/SampleRate))
+		}
+		pkt, err := enc.Encode(pcm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt == nil {
+			continue
+		}
+		n, err := dec.Decode(pkt.Payload, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != FrameSamples {
+			t.Fatalf("decoded %d samples, want %d", n, FrameSamples)
+		}
+		for _, v := range out[:n] {
+			energy += float64(v) * float64(v)
+		}
+	}
+	if energy == 0 {
+		t.Error("decoded tone is silent")
+	}
+}
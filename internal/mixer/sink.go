@@ -0,0 +1,195 @@
+package mixer
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// Sink — получатель кадров сведения (файл записи)
+type Sink interface {
+	WriteFrame(pcm []float32) error
+	Close() error
+}
+
+// форматы файла сведения
+const (
+	FormatOgg = "ogg" // Ogg/Opus
+	FormatWAV = "wav" // PCM 16 бит
+)
+
+// ErrUnknownFormat — формат файла не поддерживается
+var ErrUnknownFormat = errors.New("unknown mix format")
+
+// ValidFormat сообщает, поддерживается ли формат файла сведения
+func ValidFormat(format string) bool {
+	return format == FormatOgg || format == FormatWAV
+}
+
+// NewFileSink создаёт файл сведения path в формате format (ogg или wav)
+func NewFileSink(path, format string) (Sink, error) {
+	switch strings.ToLower(format) {
+	case FormatOgg:
+		return newOggSink(path)
+	case FormatWAV:
+		return newWAVSink(path)
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// wavSink пишет PCM 16 бит моно; размеры в заголовке проставляются в Close
+type wavSink struct {
+	f       *os.File
+	samples uint32
+	buf     []byte
+}
+
+const wavHeaderSize = 44
+
+func newWAVSink(path string) (*wavSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavSink{f: f, buf: make([]byte, FrameSamples*2)}
+	if _, err := f.Write(w.header()); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// header — заголовок RIFF/WAVE под текущее число сэмплов
+func (w *wavSink) header() []byte {
+	const (
+		channels      = 1
+		bitsPerSample = 16
+		blockAlign    = channels * bitsPerSample / 8
+	)
+	dataSize := w.samples * blockAlign
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+dataSize)
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], channels)
+	binary.LittleEndian.PutUint32(h[24:], SampleRate)
+	binary.LittleEndian.PutUint32(h[28:], SampleRate*blockAlign)
+	binary.LittleEndian.PutUint16(h[32:], blockAlign)
+	binary.LittleEndian.PutUint16(h[34:], bitsPerSample)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataSize)
+	return h
+}
+
+func (w *wavSink) WriteFrame(pcm []float32) error {
+	buf := w.buf[:0]
+	for _, v := range pcm {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(toInt16(v)))
+	}
+	w.buf = buf
+	if _, err := w.f.Write(buf); err != nil {
+		return err
+	}
+	w.samples += uint32(len(pcm))
+	return nil
+}
+
+func (w *wavSink) Close() error {
+	if _, err := w.f.WriteAt(w.header(), 0); err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// oggSink кодирует кадры в Opus и пишет их через oggwriter
+type oggSink struct {
+	enc *Encoder
+	w   *oggwriter.OggWriter
+}
+
+func newOggSink(path string) (*oggSink, error) {
+	enc, err := NewEncoder()
+	if err != nil {
+		return nil, err
+	}
+	w, err := oggwriter.New(path, SampleRate, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &oggSink{enc: enc, w: w}, nil
+}
+
+func (o *oggSink) WriteFrame(pcm []float32) error {
+	pkt, err := o.enc.Encode(pcm)
+	if err != nil || pkt == nil {
+		return err
+	}
+	return o.w.WriteRTP(pkt)
+}
+
+func (o *oggSink) Close() error {
+	return o.w.Close()
+}
+
+// Encoder кодирует кадры сведения в Opus RTP-пакеты с непрерывными seq/timestamp
+type Encoder struct {
+	enc encoder
+	pcm []float32
+	buf []byte
+	seq uint16
+	ts  uint32
+}
+
+// NewEncoder создаёт Opus-кодер для кадров сведения (моно, 20 мс, режим VoIP)
+func NewEncoder() (*Encoder, error) {
+	enc, err := newEncoder()
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{enc: enc, pcm: make([]float32, FrameSamples), buf: make([]byte, 4000)}, nil
+}
+
+// Encode кодирует кадр из FrameSamples сэмплов. возвращает nil, если кодер
+// ещё набирает lookahead — timestamp при этом всё равно сдвигается
+func (e *Encoder) Encode(pcm []float32) (*rtp.Packet, error) {
+	ts := e.ts
+	e.ts += FrameSamples
+	// сумма источников может выйти за [-1, 1] — ограничиваем перед кодированием
+	for i, v := range pcm {
+		e.pcm[i] = clip(v)
+	}
+	n, err := e.enc.Encode(e.pcm, e.buf)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: e.seq,
+			Timestamp:      ts,
+		},
+		Payload: append([]byte(nil), e.buf[:n]...),
+	}
+	e.seq++
+	return pkt, nil
+}
+
+// clip ограничивает сэмпл диапазоном [-1, 1]
+func clip(v float32) float32 {
+	return float32(math.Max(-1, math.Min(1, float64(v))))
+}
+
+// toInt16 переводит сэмпл в int16 с насыщением (сумма источников может выйти за диапазон)
+func toInt16(v float32) int16 {
+	return int16(clip(v) * math.MaxInt16)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"math"
 	"os"
 	"strings"
 	"time"
@@ -16,6 +17,24 @@ var db *sql.DB
 
 var ErrDuplicateUsername = errors.New("username already exists")
 
+var ErrRoomExists = errors.New("room already exists")
+
+// видимость комнаты
+const (
+	// RoomPublic — войти может любой авторизованный пользователь (если задан пароль — с паролем)
+	RoomPublic = "public"
+	// RoomPrivate — участники входят свободно, остальные только по паролю комнаты
+	RoomPrivate = "private"
+	// RoomInviteOnly — войти могут только владелец и участники, добавленные владельцем
+	RoomInviteOnly = "invite-only"
+)
+
+// роли участников комнаты; владелец комнаты всегда обладает правами модератора
+const (
+	RoleMember    = "member"
+	RoleModerator = "moderator"
+)
+
 type User struct {
 	ID          string
 	Username    string
@@ -23,6 +42,44 @@ type User struct {
 	CreatedAt   time.Time
 }
 
+type Room struct {
+	ID           string
+	OwnerID      string
+	Visibility   string
+	PasswordHash string `json:"-"`
+	LastN        int    // размер пула слотов last-N, 0 — каждый источник отдельным треком
+	CreatedAt    time.Time
+}
+
+// виды записей
+const (
+	// RecordingTrack — запись одного участника (Ogg/Opus)
+	RecordingTrack = "track"
+	// RecordingMix — сведение всей комнаты в один файл (Ogg/Opus или WAV)
+	RecordingMix = "mix"
+)
+
+// Recording — файл записи комнаты на диске сервера: участника или сведение всей комнаты
+type Recording struct {
+	ID        string
+	RoomID    string
+	UserID    string // "" для сведения
+	Kind      string
+	Path      string `json:"-"`
+	StartedAt time.Time
+	EndedAt   *time.Time // nil — запись ещё идёт
+}
+
+// Message — сообщение текстового чата комнаты
+type Message struct {
+	ID          int64 // растёт со временем, курсор для постраничной истории
+	RoomID      string
+	UserID      string
+	DisplayName string // имя автора на момент чтения
+	Text        string
+	CreatedAt   time.Time
+}
+
 func Init(ctx context.Context) error {
 	// пробуем взять строку подключения к БД из переменной окружения DATABASE_URL
 	dsn := os.Getenv("DATABASE_URL")
@@ -55,6 +112,77 @@ func Init(ctx context.Context) error {
         display_name TEXT NOT NULL,
         created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
     );
+    `)
+	if err != nil {
+		return err
+	}
+
+	// таблица комнат: владелец, видимость, необязательный пароль (bcrypt-хеш, пустая строка — без пароля)
+	// и размер пула слотов last-N (0 — режим выключен)
+	// и таблица участников комнаты (membership) для private/invite-only комнат с ролью member/moderator
+	_, err = db.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS rooms (
+        id TEXT PRIMARY KEY,
+        owner_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        visibility TEXT NOT NULL DEFAULT 'public',
+        password_hash TEXT NOT NULL DEFAULT '',
+        last_n INTEGER NOT NULL DEFAULT 0,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+    CREATE TABLE IF NOT EXISTS room_members (
+        room_id TEXT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        role TEXT NOT NULL DEFAULT 'member',
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        PRIMARY KEY (room_id, user_id)
+    );
+    `)
+	if err != nil {
+		return err
+	}
+
+	// список банов комнаты
+	_, err = db.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS room_bans (
+        room_id TEXT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        banned_by TEXT NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        PRIMARY KEY (room_id, user_id)
+    );
+    `)
+	if err != nil {
+		return err
+	}
+
+	// записи комнат: по файлу на участника (kind='track') или одно сведение комнаты
+	// (kind='mix', user_id NULL — не принадлежит участнику); ended_at NULL — запись идёт
+	_, err = db.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS recordings (
+        id TEXT PRIMARY KEY,
+        room_id TEXT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+        kind TEXT NOT NULL DEFAULT 'track',
+        path TEXT NOT NULL,
+        started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+        ended_at TIMESTAMP WITH TIME ZONE
+    );
+    CREATE INDEX IF NOT EXISTS recordings_room_idx ON recordings (room_id, started_at);
+    `)
+	if err != nil {
+		return err
+	}
+
+	// текстовый чат комнат; id — курсор для постраничной истории
+	_, err = db.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS messages (
+        id BIGSERIAL PRIMARY KEY,
+        room_id TEXT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        text TEXT NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+    );
+    CREATE INDEX IF NOT EXISTS messages_room_idx ON messages (room_id, id);
     `)
 	return err
 }
@@ -117,3 +245,360 @@ func GetUserByID(ctx context.Context, id string) (*User, error) {
 	// возвращаем данные пользователя
 	return &u, nil
 }
+
+func GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	var u User
+	// выполняем запрос к БД для получения данных пользователя по username
+	row := db.QueryRowContext(ctx, `SELECT id, username, display_name, created_at FROM users WHERE username=$1`, username)
+	if err := row.Scan(&u.ID, &u.Username, &u.DisplayName, &u.CreatedAt); err != nil {
+		// если пользователь не найден, возвращаем nil без ошибки
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// CreateRoom создаёт комнату с владельцем ownerID. пустой password — комната без пароля.
+// владелец сразу добавляется в участники комнаты.
+func CreateRoom(ctx context.Context, id, ownerID, visibility, password string, lastN int) (*Room, error) {
+	hash, err := hashRoomPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// откат после Commit ничего не делает, поэтому его можно безопасно отложить
+	defer func() { _ = tx.Rollback() }()
+
+	r := Room{ID: id, OwnerID: ownerID, Visibility: visibility, PasswordHash: hash, LastN: lastN}
+	row := tx.QueryRowContext(ctx, `INSERT INTO rooms (id, owner_id, visibility, password_hash, last_n) VALUES ($1,$2,$3,$4,$5) RETURNING created_at`, id, ownerID, visibility, hash, lastN)
+	if err := row.Scan(&r.CreatedAt); err != nil {
+		// проверяем, не является ли это ошибкой нарушения уникальности id комнаты
+		if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "23505") {
+			return nil, ErrRoomExists
+		}
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO room_members (room_id, user_id) VALUES ($1,$2)`, id, ownerID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func GetRoom(ctx context.Context, id string) (*Room, error) {
+	var r Room
+	// выполняем запрос к БД для получения комнаты по ID
+	row := db.QueryRowContext(ctx, `SELECT id, owner_id, visibility, password_hash, last_n, created_at FROM rooms WHERE id=$1`, id)
+	if err := row.Scan(&r.ID, &r.OwnerID, &r.Visibility, &r.PasswordHash, &r.LastN, &r.CreatedAt); err != nil {
+		// если комната не найдена, возвращаем nil без ошибки
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &r, nil
+}
+
+// RoomListing — комната из списка вместе с отношением к ней пользователя, который запросил список
+type RoomListing struct {
+	Room
+	Banned bool // пользователь забанен в комнате
+	Member bool // пользователь — участник комнаты
+}
+
+// ListRooms одним запросом возвращает комнаты с id из ids (упорядоченные по id) вместе с баном
+// и членством userID. id, которых нет в БД, пропускаются
+func ListRooms(ctx context.Context, ids []string, userID string) ([]RoomListing, error) {
+	rows, err := db.QueryContext(ctx, `SELECT r.id, r.owner_id, r.visibility, r.password_hash, r.last_n, r.created_at,
+        EXISTS (SELECT 1 FROM room_bans b WHERE b.room_id=r.id AND b.user_id=$2),
+        EXISTS (SELECT 1 FROM room_members m WHERE m.room_id=r.id AND m.user_id=$2)
+        FROM rooms r WHERE r.id = ANY($1) ORDER BY r.id`, ids, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []RoomListing
+	for rows.Next() {
+		var l RoomListing
+		if err := rows.Scan(&l.ID, &l.OwnerID, &l.Visibility, &l.PasswordHash, &l.LastN, &l.CreatedAt, &l.Banned, &l.Member); err != nil {
+			return nil, err
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+// UpdateRoom меняет видимость комнаты, размер пула last-N и, если password != nil, её пароль
+// (пустая строка снимает пароль). возвращает false, если комнаты нет.
+func UpdateRoom(ctx context.Context, id, visibility string, lastN int, password *string) (bool, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	if password == nil {
+		res, err = db.ExecContext(ctx, `UPDATE rooms SET visibility=$2, last_n=$3 WHERE id=$1`, id, visibility, lastN)
+	} else {
+		hash, herr := hashRoomPassword(*password)
+		if herr != nil {
+			return false, herr
+		}
+		res, err = db.ExecContext(ctx, `UPDATE rooms SET visibility=$2, last_n=$3, password_hash=$4 WHERE id=$1`, id, visibility, lastN, hash)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteRoom удаляет комнату (участники, баны, записи и чат удаляются каскадно).
+// возвращает false, если комнаты нет, и пути файлов удалённых записей — файлы удаляет вызывающий.
+func DeleteRoom(ctx context.Context, id string) (bool, []string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// блокировка строки комнаты не даёт параллельно добавить запись, путь которой мы не увидим
+	var locked string
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id=$1 FOR UPDATE`, id).Scan(&locked); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `DELETE FROM recordings WHERE room_id=$1 RETURNING path`, id)
+	if err != nil {
+		return false, nil, err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return false, nil, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM rooms WHERE id=$1`, id); err != nil {
+		return false, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, nil, err
+	}
+	return true, paths, nil
+}
+
+// CheckPassword сообщает, подходит ли пароль к комнате. комната без пароля принимает любой.
+func (r *Room) CheckPassword(password string) bool {
+	if r.PasswordHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(r.PasswordHash), []byte(password)) == nil
+}
+
+// AddRoomMember добавляет пользователя в участники комнаты (повторное добавление — не ошибка)
+func AddRoomMember(ctx context.Context, roomID, userID string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO room_members (room_id, user_id) VALUES ($1,$2) ON CONFLICT DO NOTHING`, roomID, userID)
+	return err
+}
+
+// RemoveRoomMember удаляет пользователя из участников комнаты
+func RemoveRoomMember(ctx context.Context, roomID, userID string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM room_members WHERE room_id=$1 AND user_id=$2`, roomID, userID)
+	return err
+}
+
+// IsRoomMember сообщает, является ли пользователь участником комнаты
+func IsRoomMember(ctx context.Context, roomID, userID string) (bool, error) {
+	var ok bool
+	row := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id=$1 AND user_id=$2)`, roomID, userID)
+	if err := row.Scan(&ok); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// SetRoomRole назначает участнику комнаты роль (добавляя его в участники, если его там нет)
+func SetRoomRole(ctx context.Context, roomID, userID, role string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO room_members (room_id, user_id, role) VALUES ($1,$2,$3)
+        ON CONFLICT (room_id, user_id) DO UPDATE SET role=EXCLUDED.role`, roomID, userID, role)
+	return err
+}
+
+// DemoteModerator снимает с участника комнаты роль модератора, оставляя его участником.
+// возвращает false, если пользователь не модератор этой комнаты
+func DemoteModerator(ctx context.Context, roomID, userID string) (bool, error) {
+	res, err := db.ExecContext(ctx, `UPDATE room_members SET role=$3 WHERE room_id=$1 AND user_id=$2 AND role=$4`,
+		roomID, userID, RoleMember, RoleModerator)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// IsRoomModerator сообщает, может ли пользователь модерировать комнату: владелец или роль moderator
+func IsRoomModerator(ctx context.Context, roomID, userID string) (bool, error) {
+	var ok bool
+	row := db.QueryRowContext(ctx, `SELECT
+        EXISTS (SELECT 1 FROM rooms WHERE id=$1 AND owner_id=$2) OR
+        EXISTS (SELECT 1 FROM room_members WHERE room_id=$1 AND user_id=$2 AND role='moderator')`, roomID, userID)
+	if err := row.Scan(&ok); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// BanUser запрещает пользователю вход в комнату и убирает его из участников
+func BanUser(ctx context.Context, roomID, userID, bannedBy string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO room_bans (room_id, user_id, banned_by) VALUES ($1,$2,$3) ON CONFLICT DO NOTHING`, roomID, userID, bannedBy); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM room_members WHERE room_id=$1 AND user_id=$2`, roomID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnbanUser снимает бан пользователя в комнате
+func UnbanUser(ctx context.Context, roomID, userID string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM room_bans WHERE room_id=$1 AND user_id=$2`, roomID, userID)
+	return err
+}
+
+// IsBanned сообщает, забанен ли пользователь в комнате
+func IsBanned(ctx context.Context, roomID, userID string) (bool, error) {
+	var ok bool
+	row := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM room_bans WHERE room_id=$1 AND user_id=$2)`, roomID, userID)
+	if err := row.Scan(&ok); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// ValidVisibility сообщает, является ли строка допустимой видимостью комнаты
+func ValidVisibility(v string) bool {
+	return v == RoomPublic || v == RoomPrivate || v == RoomInviteOnly
+}
+
+// hashRoomPassword хеширует пароль комнаты bcrypt; пустой пароль — пустой хеш (комната без пароля)
+func hashRoomPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CreateRecording сохраняет метаданные начатой записи вида kind в комнате roomID.
+// userID — участник для RecordingTrack, пустой для RecordingMix
+func CreateRecording(ctx context.Context, id, roomID, userID, kind, path string) (*Recording, error) {
+	rec := Recording{ID: id, RoomID: roomID, UserID: userID, Kind: kind, Path: path}
+	row := db.QueryRowContext(ctx, `INSERT INTO recordings (id, room_id, user_id, kind, path) VALUES ($1,$2,NULLIF($3,''),$4,$5) RETURNING started_at`, id, roomID, userID, kind, path)
+	if err := row.Scan(&rec.StartedAt); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// FinishRecording отмечает время окончания записи
+func FinishRecording(ctx context.Context, id string) error {
+	_, err := db.ExecContext(ctx, `UPDATE recordings SET ended_at=now() WHERE id=$1 AND ended_at IS NULL`, id)
+	return err
+}
+
+// GetRecording возвращает запись по id или nil, если её нет
+func GetRecording(ctx context.Context, id string) (*Recording, error) {
+	var rec Recording
+	row := db.QueryRowContext(ctx, `SELECT id, room_id, COALESCE(user_id, ''), kind, path, started_at, ended_at FROM recordings WHERE id=$1`, id)
+	if err := row.Scan(&rec.ID, &rec.RoomID, &rec.UserID, &rec.Kind, &rec.Path, &rec.StartedAt, &rec.EndedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// ListRecordings возвращает записи комнаты, новые первыми
+func ListRecordings(ctx context.Context, roomID string) ([]Recording, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, room_id, COALESCE(user_id, ''), kind, path, started_at, ended_at FROM recordings WHERE room_id=$1 ORDER BY started_at DESC`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Recording{}
+	for rows.Next() {
+		var rec Recording
+		if err := rows.Scan(&rec.ID, &rec.RoomID, &rec.UserID, &rec.Kind, &rec.Path, &rec.StartedAt, &rec.EndedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+// CreateMessage сохраняет сообщение чата и возвращает его с id и временем
+func CreateMessage(ctx context.Context, roomID, userID, text string) (*Message, error) {
+	msg := Message{RoomID: roomID, UserID: userID, Text: text}
+	row := db.QueryRowContext(ctx, `
+    INSERT INTO messages (room_id, user_id, text) VALUES ($1,$2,$3)
+    RETURNING id, created_at, (SELECT display_name FROM users WHERE id=$2)`, roomID, userID, text)
+	if err := row.Scan(&msg.ID, &msg.CreatedAt, &msg.DisplayName); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ListMessages возвращает до limit последних сообщений комнаты с id меньше before
+// (before <= 0 — самые последние), от старых к новым
+func ListMessages(ctx context.Context, roomID string, before int64, limit int) ([]Message, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	rows, err := db.QueryContext(ctx, `
+    SELECT id, room_id, user_id, display_name, text, created_at FROM (
+        SELECT m.id, m.room_id, m.user_id, u.display_name, m.text, m.created_at
+        FROM messages m JOIN users u ON u.id = m.user_id
+        WHERE m.room_id=$1 AND m.id < $2
+        ORDER BY m.id DESC LIMIT $3
+    ) page ORDER BY id`, roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Message{}
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.DisplayName, &msg.Text, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, msg)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,283 @@
+package turnserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"voicechat/internal/ice"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// reserveTimeout — сколько живёт слот квоты, занятый в quotaHandler, если allocation так и
+// не создалась: pion не сообщает о неудаче создания, поэтому резерв снимается по времени
+const reserveTimeout = 5 * time.Second
+
+// reservation — слот квоты, занятый под создающуюся allocation
+type reservation struct {
+	userID string
+	at     time.Time
+}
+
+// Server — встроенный TURN relay (UDP + TCP на одном порту).
+// клиенты получают его адрес и временные учётки через /api/ice-servers,
+// учётки выписываются только пользователям с валидным JWT (см. ice.TURNCredentials).
+type Server struct {
+	srv   *turn.Server
+	quota int
+
+	// allocs — число активных и создающихся allocation на пользователя, ключ — userID из учётки
+	allocs map[string]int
+	// pending — слоты квоты, занятые под ещё не созданные allocation, ключ — адрес клиента
+	pending map[string]reservation
+	mtx     sync.Mutex
+
+	// счётчики отдаются в Prometheus (см. registerMetrics)
+	authSuccess        atomic.Uint64 // успешные проверки учёток
+	authFailure        atomic.Uint64 // отклонённые учётки (неверный формат, истёк срок, неверный HMAC)
+	allocationsTotal   atomic.Uint64 // сколько allocation создано за всё время
+	allocationsActive  atomic.Int64  // сколько allocation живо сейчас
+	quotaRejected      atomic.Uint64 // отказы из-за превышения квоты пользователя
+	allocationFailures atomic.Uint64 // allocation, завершившиеся с ошибкой
+}
+
+// Start запускает встроенный TURN-сервер, если VOICECHAT_TURN_EMBEDDED=true.
+// если сервер выключен, возвращает nil, nil. Настройки:
+//   - VOICECHAT_TURN_PUBLIC_IP — публичный IP, который получат клиенты как relay-адрес (обязателен)
+//   - VOICECHAT_TURN_PORT — порт для UDP и TCP (по умолчанию 3478)
+//   - VOICECHAT_TURN_REALM — realm (по умолчанию "voicechat")
+//   - VOICECHAT_TURN_USER_QUOTA — максимум одновременных allocation на пользователя (по умолчанию 10)
+func Start() (*Server, error) {
+	if on, _ := strconv.ParseBool(os.Getenv("VOICECHAT_TURN_EMBEDDED")); !on {
+		return nil, nil
+	}
+
+	publicIP := net.ParseIP(os.Getenv("VOICECHAT_TURN_PUBLIC_IP"))
+	if publicIP == nil {
+		return nil, fmt.Errorf("VOICECHAT_TURN_PUBLIC_IP must be a valid IP for embedded TURN")
+	}
+	port := envInt("VOICECHAT_TURN_PORT", 3478)
+	realm := os.Getenv("VOICECHAT_TURN_REALM")
+	if realm == "" {
+		realm = "voicechat"
+	}
+
+	s := &Server{
+		quota:   envInt("VOICECHAT_TURN_USER_QUOTA", 10),
+		allocs:  make(map[string]int),
+		pending: make(map[string]reservation),
+	}
+
+	addr := "0.0.0.0:" + strconv.Itoa(port)
+	udpConn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("turn udp listen: %w", err)
+	}
+	tcpLn, err := net.Listen("tcp4", addr)
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, fmt.Errorf("turn tcp listen: %w", err)
+	}
+
+	// relay-сокеты открываются на всех интерфейсах, клиенту сообщается публичный IP
+	relayGen := &turn.RelayAddressGeneratorStatic{
+		RelayAddress: publicIP,
+		Address:      "0.0.0.0",
+	}
+
+	srv, err := turn.NewServer(turn.ServerConfig{
+		Realm:         realm,
+		AuthHandler:   s.authHandler,
+		QuotaHandler:  s.quotaHandler,
+		EventHandler:  s.eventHandler(),
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udpConn,
+			RelayAddressGenerator: relayGen,
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcpLn,
+			RelayAddressGenerator: relayGen,
+		}},
+	})
+	if err != nil {
+		_ = udpConn.Close()
+		_ = tcpLn.Close()
+		return nil, err
+	}
+	s.srv = srv
+	s.registerMetrics()
+
+	// отдаём клиентам адрес встроенного сервера вместе с остальными ICE-серверами
+	host := net.JoinHostPort(publicIP.String(), strconv.Itoa(port))
+	ice.UseEmbeddedTURN([]string{
+		"turn:" + host + "?transport=udp",
+		"turn:" + host + "?transport=tcp",
+	})
+
+	log.Printf("embedded TURN listening on %s (udp+tcp), relay ip %s, quota %d/user\n", addr, publicIP, s.quota)
+	return s, nil
+}
+
+// Close останавливает TURN-сервер и закрывает все allocation
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// registerMetrics отдаёт счётчики сервера в Prometheus (GET /metrics)
+func (s *Server) registerMetrics() {
+	counters := []struct {
+		name, help string
+		v          *atomic.Uint64
+	}{
+		{"voicechat_turn_auth_success_total", "Embedded TURN credentials accepted.", &s.authSuccess},
+		{"voicechat_turn_auth_failure_total", "Embedded TURN credentials rejected (format, expiry or HMAC).", &s.authFailure},
+		{"voicechat_turn_allocations_total", "Embedded TURN allocations created.", &s.allocationsTotal},
+		{"voicechat_turn_quota_rejected_total", "Embedded TURN allocations rejected by the per-user quota.", &s.quotaRejected},
+		{"voicechat_turn_allocation_failures_total", "Embedded TURN allocations that ended with an error.", &s.allocationFailures},
+	}
+	for _, c := range counters {
+		v := c.v
+		promauto.NewCounterFunc(prometheus.CounterOpts{Name: c.name, Help: c.help}, func() float64 {
+			return float64(v.Load())
+		})
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "voicechat_turn_allocations_active",
+		Help: "Embedded TURN allocations currently alive.",
+	}, func() float64 {
+		return float64(s.allocationsActive.Load())
+	})
+}
+
+// authHandler проверяет временную учётку "<expiry>:<userID>" и возвращает ключ
+// MD5(username:realm:password), которым pion проверяет MESSAGE-INTEGRITY запроса
+func (s *Server) authHandler(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	_, password, ok := ice.VerifyTURNUsername(username)
+	if !ok {
+		s.authFailure.Add(1)
+		log.Printf("turn auth rejected: username=%q from %s\n", username, srcAddr)
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, password), true
+}
+
+// quotaHandler отклоняет новую allocation, если у пользователя их уже quota штук,
+// иначе сразу занимает под неё слот: параллельные запросы не могут превысить квоту,
+// пока allocation ещё создаются. слот переходит к allocation в OnAllocationCreated
+func (s *Server) quotaHandler(username, realm string, srcAddr net.Addr) bool {
+	userID, _, ok := ice.VerifyTURNUsername(username)
+	if !ok {
+		return false
+	}
+	key := srcAddr.String()
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.expireReservations(now)
+	if r, ok := s.pending[key]; ok && r.userID == userID {
+		// повтор Allocate того же клиента — слот уже занят
+		return true
+	}
+	if s.allocs[userID] >= s.quota {
+		s.quotaRejected.Add(1)
+		log.Printf("turn quota reached for user %s (%d allocations)\n", userID, s.allocs[userID])
+		return false
+	}
+	s.allocs[userID]++
+	s.pending[key] = reservation{userID: userID, at: now}
+	return true
+}
+
+// expireReservations освобождает слоты allocation, которые так и не создались за reserveTimeout.
+// вызывается под s.mtx
+func (s *Server) expireReservations(now time.Time) {
+	for key, r := range s.pending {
+		if now.Sub(r.at) > reserveTimeout {
+			delete(s.pending, key)
+			s.release(r.userID)
+		}
+	}
+}
+
+// release освобождает слот квоты пользователя. вызывается под s.mtx
+func (s *Server) release(userID string) {
+	if s.allocs[userID] <= 1 {
+		delete(s.allocs, userID)
+	} else {
+		s.allocs[userID]--
+	}
+}
+
+// eventHandler ведёт учёт allocation по пользователям и счётчики сервера
+func (s *Server) eventHandler() turn.EventHandler {
+	return turn.EventHandler{
+		OnAuth: func(srcAddr, dstAddr net.Addr, protocol, username, realm, method string, verdict bool) {
+			// неудачи с неверным форматом/сроком считаются в authHandler, здесь — итог проверки HMAC
+			if verdict {
+				s.authSuccess.Add(1)
+			} else {
+				s.authFailure.Add(1)
+			}
+		},
+		OnAllocationCreated: func(srcAddr, dstAddr net.Addr, protocol, username, realm string, relayAddr net.Addr, requestedPort int) {
+			userID := userIDFromUsername(username)
+			s.mtx.Lock()
+			if r, ok := s.pending[srcAddr.String()]; ok && r.userID == userID {
+				// слот занят ещё в quotaHandler
+				delete(s.pending, srcAddr.String())
+			} else {
+				// резерв успел истечь — учитываем allocation заново
+				s.allocs[userID]++
+			}
+			s.mtx.Unlock()
+			s.allocationsTotal.Add(1)
+			s.allocationsActive.Add(1)
+			log.Printf("turn allocation created: user=%s %s relay=%s\n", userID, protocol, relayAddr)
+		},
+		OnAllocationDeleted: func(srcAddr, dstAddr net.Addr, protocol, username, realm string) {
+			// учётка к этому моменту могла истечь, поэтому userID берём без проверки срока
+			userID := userIDFromUsername(username)
+			s.mtx.Lock()
+			s.release(userID)
+			s.mtx.Unlock()
+			s.allocationsActive.Add(-1)
+		},
+		OnAllocationError: func(srcAddr, dstAddr net.Addr, protocol, message string) {
+			s.allocationFailures.Add(1)
+			log.Printf("turn allocation error from %s: %s\n", srcAddr, message)
+		},
+	}
+}
+
+// userIDFromUsername возвращает userID из username вида "<expiry>:<userID>"
+func userIDFromUsername(username string) string {
+	if _, userID, ok := strings.Cut(username, ":"); ok {
+		return userID
+	}
+	return username
+}
+
+// envInt читает положительное целое из переменной окружения, иначе возвращает def
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("invalid %s=%q, using %d\n", name, v, def)
+		return def
+	}
+	return n
+}
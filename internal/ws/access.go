@@ -0,0 +1,134 @@
+package ws
+
+import (
+	"context"
+	"errors"
+
+	"voicechat/internal/store"
+)
+
+// коды ошибок входа в комнату, передаются клиенту в сообщении {"type":"error","code":...}
+const (
+	CodeRoomForbidden        = "room_forbidden"         // комната только по приглашению, пользователь не участник
+	CodeRoomPasswordRequired = "room_password_required" // у комнаты есть пароль, а в join его нет
+	CodeRoomWrongPassword    = "room_wrong_password"    // пароль комнаты не подошёл
+	CodeRoomBanned           = "room_banned"            // пользователь забанен модератором комнаты
+	CodeInternal             = "internal"               // ошибка сервера (БД и т.п.)
+)
+
+// accessStore — запросы к БД, на которых держатся проверки входа в authorizeJoin;
+// в тестах подменяется, чтобы проверять правила доступа без Postgres
+type accessStore interface {
+	GetRoom(ctx context.Context, id string) (*store.Room, error)
+	CreateRoom(ctx context.Context, id, ownerID, visibility, password string, lastN int) (*store.Room, error)
+	IsBanned(ctx context.Context, roomID, userID string) (bool, error)
+	IsRoomMember(ctx context.Context, roomID, userID string) (bool, error)
+	AddRoomMember(ctx context.Context, roomID, userID string) error
+}
+
+// access — хранилище, по которому authorizeJoin проверяет вход
+var access accessStore = dbAccess{}
+
+// dbAccess — accessStore поверх пакета store
+type dbAccess struct{}
+
+func (dbAccess) GetRoom(ctx context.Context, id string) (*store.Room, error) {
+	return store.GetRoom(ctx, id)
+}
+
+func (dbAccess) CreateRoom(ctx context.Context, id, ownerID, visibility, password string, lastN int) (*store.Room, error) {
+	return store.CreateRoom(ctx, id, ownerID, visibility, password, lastN)
+}
+
+func (dbAccess) IsBanned(ctx context.Context, roomID, userID string) (bool, error) {
+	return store.IsBanned(ctx, roomID, userID)
+}
+
+func (dbAccess) IsRoomMember(ctx context.Context, roomID, userID string) (bool, error) {
+	return store.IsRoomMember(ctx, roomID, userID)
+}
+
+func (dbAccess) AddRoomMember(ctx context.Context, roomID, userID string) error {
+	return store.AddRoomMember(ctx, roomID, userID)
+}
+
+// authorizeJoin проверяет, может ли пользователь userID войти в комнату roomID, и возвращает её настройки.
+// если комнаты ещё нет в БД, она создаётся публичной, а пользователь становится её владельцем.
+// правила по видимости:
+//   - public: вход свободный; если у комнаты есть пароль — только с паролем (участники без пароля)
+//   - private: участники входят свободно, остальные по паролю и после этого становятся участниками
+//   - invite-only: только владелец и участники
+//
+// отказ возвращается как ProtocolError с кодом для клиента (room_*, internal)
+func authorizeJoin(ctx context.Context, roomID, userID, password string) (*store.Room, *ProtocolError) {
+	room, err := access.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, &ProtocolError{Code: CodeInternal, Message: "room lookup failed"}
+	}
+	if room == nil {
+		// первый вошедший создаёт комнату и становится владельцем
+		room, err = access.CreateRoom(ctx, roomID, userID, store.RoomPublic, "", lastN)
+		if errors.Is(err, store.ErrRoomExists) {
+			// комнату параллельно создал кто-то другой — перечитываем и проверяем по общим правилам
+			room, err = access.GetRoom(ctx, roomID)
+		}
+		if err != nil || room == nil {
+			return nil, &ProtocolError{Code: CodeInternal, Message: "room create failed"}
+		}
+	}
+
+	banned, err := access.IsBanned(ctx, roomID, userID)
+	if err != nil {
+		return nil, &ProtocolError{Code: CodeInternal, Message: "ban lookup failed"}
+	}
+	if banned {
+		return nil, &ProtocolError{Code: CodeRoomBanned, Message: "you are banned from this room"}
+	}
+
+	// владелец входит всегда
+	if room.OwnerID == userID {
+		return room, nil
+	}
+
+	member, err := access.IsRoomMember(ctx, roomID, userID)
+	if err != nil {
+		return nil, &ProtocolError{Code: CodeInternal, Message: "membership lookup failed"}
+	}
+	if member {
+		return room, nil
+	}
+
+	switch room.Visibility {
+	case store.RoomInviteOnly:
+		return nil, &ProtocolError{Code: CodeRoomForbidden, Message: "room is invite-only"}
+	case store.RoomPrivate:
+		// private без пароля — попасть можно только по приглашению
+		if room.PasswordHash == "" {
+			return nil, &ProtocolError{Code: CodeRoomForbidden, Message: "room is private"}
+		}
+		if err := checkRoomPassword(room, password); err != nil {
+			return nil, err
+		}
+		// знающий пароль становится участником и дальше входит без него
+		if err := access.AddRoomMember(ctx, roomID, userID); err != nil {
+			return nil, &ProtocolError{Code: CodeInternal, Message: "membership update failed"}
+		}
+		return room, nil
+	default:
+		if err := checkRoomPassword(room, password); err != nil {
+			return nil, err
+		}
+		return room, nil
+	}
+}
+
+// checkRoomPassword проверяет пароль комнаты и возвращает отказ с подходящим кодом
+func checkRoomPassword(room *store.Room, password string) *ProtocolError {
+	if room.CheckPassword(password) {
+		return nil
+	}
+	if password == "" {
+		return &ProtocolError{Code: CodeRoomPasswordRequired, Message: "room password required"}
+	}
+	return &ProtocolError{Code: CodeRoomWrongPassword, Message: "wrong room password"}
+}
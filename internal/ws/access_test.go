@@ -0,0 +1,163 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"voicechat/internal/store"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeAccess — accessStore в памяти; ключ banned и members — roomID + "/" + userID
+type fakeAccess struct {
+	rooms   map[string]*store.Room
+	banned  map[string]bool
+	members map[string]bool
+	err     error // если задана — её возвращает любой запрос
+}
+
+func (f *fakeAccess) GetRoom(_ context.Context, id string) (*store.Room, error) {
+	return f.rooms[id], f.err
+}
+
+func (f *fakeAccess) CreateRoom(_ context.Context, id, ownerID, visibility, _ string, lastN int) (*store.Room, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	r := &store.Room{ID: id, OwnerID: ownerID, Visibility: visibility, LastN: lastN}
+	f.rooms[id] = r
+	return r, nil
+}
+
+func (f *fakeAccess) IsBanned(_ context.Context, roomID, userID string) (bool, error) {
+	return f.banned[roomID+"/"+userID], f.err
+}
+
+func (f *fakeAccess) IsRoomMember(_ context.Context, roomID, userID string) (bool, error) {
+	return f.members[roomID+"/"+userID], f.err
+}
+
+func (f *fakeAccess) AddRoomMember(_ context.Context, roomID, userID string) error {
+	f.members[roomID+"/"+userID] = true
+	return f.err
+}
+
+// useFakeAccess подменяет хранилище проверок входа на время теста
+func useFakeAccess(t *testing.T, rooms ...*store.Room) *fakeAccess {
+	t.Helper()
+	f := &fakeAccess{rooms: make(map[string]*store.Room), banned: make(map[string]bool), members: make(map[string]bool)}
+	for _, r := range rooms {
+		f.rooms[r.ID] = r
+	}
+	prev := access
+	access = f
+	t.Cleanup(func() { access = prev })
+	return f
+}
+
+// passwordHash — bcrypt-хеш пароля комнаты, как его хранит store
+func passwordHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+// joinCode возвращает код отказа authorizeJoin или "" при успешном входе
+func joinCode(roomID, userID, password string) string {
+	if _, perr := authorizeJoin(context.Background(), roomID, userID, password); perr != nil {
+		return perr.Code
+	}
+	return ""
+}
+
+func TestAuthorizeJoinCreatesRoom(t *testing.T) {
+	f := useFakeAccess(t)
+	room, perr := authorizeJoin(context.Background(), "fresh", "alice", "")
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	if room.OwnerID != "alice" || room.Visibility != store.RoomPublic {
+		t.Errorf("created room %+v, want public owned by alice", room)
+	}
+	if f.rooms["fresh"] == nil {
+		t.Error("room not stored")
+	}
+}
+
+func TestAuthorizeJoinPassword(t *testing.T) {
+	hash := passwordHash(t, "north")
+	f := useFakeAccess(t,
+		&store.Room{ID: "pub", OwnerID: "owner", Visibility: store.RoomPublic, PasswordHash: hash},
+		&store.Room{ID: "priv", OwnerID: "owner", Visibility: store.RoomPrivate, PasswordHash: hash},
+		&store.Room{ID: "closed", OwnerID: "owner", Visibility: store.RoomPrivate},
+		&store.Room{ID: "invite", OwnerID: "owner", Visibility: store.RoomInviteOnly, PasswordHash: hash},
+	)
+	f.members["pub/member"] = true
+
+	tests := []struct {
+		room, user, password string
+		code                 string
+	}{
+		{"pub", "bob", "", CodeRoomPasswordRequired},
+		{"pub", "bob", "south", CodeRoomWrongPassword},
+		{"pub", "bob", "north", ""},
+		{"pub", "member", "", ""},
+		{"pub", "owner", "", ""},
+		{"priv", "bob", "", CodeRoomPasswordRequired},
+		{"priv", "bob", "south", CodeRoomWrongPassword},
+		{"closed", "bob", "north", CodeRoomForbidden},
+		{"invite", "bob", "north", CodeRoomForbidden},
+		{"invite", "owner", "", ""},
+	}
+	for _, tt := range tests {
+		if code := joinCode(tt.room, tt.user, tt.password); code != tt.code {
+			t.Errorf("%s as %s with %q: code %q, want %q", tt.room, tt.user, tt.password, code, tt.code)
+		}
+	}
+
+	// знающий пароль private-комнаты становится участником и дальше входит без пароля
+	if code := joinCode("priv", "carol", "north"); code != "" {
+		t.Fatalf("private room with password: %q", code)
+	}
+	if !f.members["priv/carol"] {
+		t.Error("user with password not added to members")
+	}
+	if code := joinCode("priv", "carol", ""); code != "" {
+		t.Errorf("member without password: %q", code)
+	}
+}
+
+func TestAuthorizeJoinStoreError(t *testing.T) {
+	f := useFakeAccess(t)
+	f.err = errors.New("db down")
+	if code := joinCode("any", "bob", ""); code != CodeInternal {
+		t.Errorf("store failure: code %q, want %q", code, CodeInternal)
+	}
+}
+
+func TestAuthorizeJoinBanned(t *testing.T) {
+	f := useFakeAccess(t,
+		&store.Room{ID: "pub", OwnerID: "owner", Visibility: store.RoomPublic},
+		&store.Room{ID: "priv", OwnerID: "owner", Visibility: store.RoomPrivate, PasswordHash: passwordHash(t, "north")},
+	)
+	f.banned["pub/bob"] = true
+	f.banned["priv/bob"] = true
+	f.members["priv/bob"] = true
+
+	// бан сильнее открытой комнаты, членства и пароля
+	if code := joinCode("pub", "bob", ""); code != CodeRoomBanned {
+		t.Errorf("banned in public room: code %q, want %q", code, CodeRoomBanned)
+	}
+	if code := joinCode("priv", "bob", "north"); code != CodeRoomBanned {
+		t.Errorf("banned member with password: code %q, want %q", code, CodeRoomBanned)
+	}
+	// бан привязан к комнате
+	if code := joinCode("pub", "carol", ""); code != "" {
+		t.Errorf("not banned user: code %q", code)
+	}
+}
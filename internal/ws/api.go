@@ -0,0 +1,118 @@
+package ws
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// api — общий webrtc.API, через который создаются PeerConnection всех пользователей.
+// собирается один раз в Init: SettingEngine с единым UDP/TCP портом для ICE,
+// NAT 1:1 и фильтром интерфейсов, MediaEngine с audio-level. до Init используется API по умолчанию.
+var api = webrtc.NewAPI()
+
+// newAPI собирает webrtc.API из переменных окружения:
+//   - VOICECHAT_ICE_UDP_PORT — единый UDP порт для ICE всех пользователей (0/пусто — случайные порты)
+//   - VOICECHAT_ICE_TCP_PORT — порт ICE-TCP (0/пусто — ICE-TCP выключен)
+//   - VOICECHAT_NAT_1TO1_IPS — публичные IP через запятую, подставляются в host-кандидаты
+//     (сервер за NAT с пробросом порта, например в контейнере или облаке)
+//   - VOICECHAT_ICE_INTERFACES — имена сетевых интерфейсов через запятую, из которых собирать кандидатов
+func newAPI() (*webrtc.API, error) {
+	se := webrtc.SettingEngine{}
+
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+
+	if port, err := envPort("VOICECHAT_ICE_UDP_PORT"); err != nil {
+		return nil, err
+	} else if port > 0 {
+		// один сокет на все PeerConnection: ICE-трафик разводится по ufrag из STUN-запросов
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			return nil, fmt.Errorf("ice udp mux listen: %w", err)
+		}
+		se.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+		log.Printf("ICE UDP mux listening on %s\n", conn.LocalAddr())
+	}
+
+	if port, err := envPort("VOICECHAT_ICE_TCP_PORT"); err != nil {
+		return nil, err
+	} else if port > 0 {
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		if err != nil {
+			return nil, fmt.Errorf("ice tcp mux listen: %w", err)
+		}
+		se.SetICETCPMux(webrtc.NewICETCPMux(nil, ln, 8))
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+		log.Printf("ICE TCP mux listening on %s\n", ln.Addr())
+	}
+	se.SetNetworkTypes(networkTypes)
+
+	if ips := splitEnvList("VOICECHAT_NAT_1TO1_IPS"); len(ips) > 0 {
+		// подменяем адрес в host-кандидатах на публичный — клиенты сразу видят доступный адрес
+		se.SetNAT1To1IPs(ips, webrtc.ICECandidateTypeHost)
+	}
+
+	if ifaces := splitEnvList("VOICECHAT_ICE_INTERFACES"); len(ifaces) > 0 {
+		allowed := make(map[string]bool, len(ifaces))
+		for _, name := range ifaces {
+			allowed[name] = true
+		}
+		// кандидаты собираются только с разрешённых интерфейсов (без docker0, veth и т.п.)
+		se.SetInterfaceFilter(func(name string) bool {
+			return allowed[name]
+		})
+	}
+
+	// MediaEngine с кодеками по умолчанию и RFC 6464 audio-level, чтобы клиенты
+	// присылали уровень громкости в каждом пакете (детектор речи, см. vad.go)
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	// NACK для аудио: по умолчанию pion объявляет его только для видео
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeAudio)
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: audioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+	// с собственным MediaEngine интерсепторы по умолчанию (NACK generator/responder, RTCP reports) регистрируем явно
+	ir := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, ir); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(ir),
+		webrtc.WithSettingEngine(se),
+	), nil
+}
+
+// envPort читает номер порта из переменной окружения; пустое значение — 0
+func envPort(name string) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(v)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid %s=%q", name, v)
+	}
+	return port, nil
+}
+
+// splitEnvList читает список через запятую из переменной окружения
+func splitEnvList(name string) []string {
+	var out []string
+	for _, p := range strings.Split(os.Getenv(name), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"voicechat/internal/store"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// текстовый чат комнаты идёт по WebRTC DataChannel, а не по сигналингу.
+// канал заранее согласован (negotiated, id 0, label "chat"): клиент создаёт его с теми же
+// параметрами до первого offer, поэтому DCEP-рукопожатие не нужно.
+// клиент шлёт {"type":"message","text"}, сервер сохраняет сообщение в store и рассылает
+// {"type":"message","message":{...}} всем участникам комнаты, включая автора (так автор узнаёт id).
+// при открытии канала участник получает {"type":"history","messages":[...]} — последние сообщения.
+
+const (
+	// chatLabel и chatChannelID — параметры заранее согласованного канала чата
+	chatLabel            = "chat"
+	chatChannelID uint16 = 0
+	// chatMaxLen — максимальная длина сообщения в символах
+	chatMaxLen = 4000
+	// chatTimeout — ограничение на запросы к БД при обработке сообщения чата
+	chatTimeout = 5 * time.Second
+)
+
+// CodeMessageInvalid — пустое или слишком длинное сообщение чата
+const CodeMessageInvalid = "message_invalid"
+
+// ChatMessage — сообщение чата в DataChannel и в REST API истории
+type ChatMessage struct {
+	ID          int64     `json:"id"`
+	From        string    `json:"from"`
+	DisplayName string    `json:"displayName"`
+	Text        string    `json:"text"`
+	SentAt      time.Time `json:"sentAt"`
+}
+
+// NewChatMessage переводит сообщение из store в формат клиента
+func NewChatMessage(m store.Message) ChatMessage {
+	return ChatMessage{ID: m.ID, From: m.UserID, DisplayName: m.DisplayName, Text: m.Text, SentAt: m.CreatedAt}
+}
+
+// chatEnvelope — сообщение в канале чата
+type chatEnvelope struct {
+	Type     string        `json:"type"`               // "message", "history", "error"
+	Text     string        `json:"text,omitempty"`     // текст нового сообщения (от клиента)
+	Message  *ChatMessage  `json:"message,omitempty"`  // сохранённое сообщение (for message)
+	Messages []ChatMessage `json:"messages,omitempty"` // последние сообщения комнаты (for history)
+	Code     string        `json:"code,omitempty"`     // код ошибки (for error)
+	Error    string        `json:"error,omitempty"`
+}
+
+// openChat создаёт на PeerConnection заранее согласованный канал чата
+func (u *User) openChat(pc *webrtc.PeerConnection) error {
+	negotiated := true
+	id := chatChannelID
+	dc, err := pc.CreateDataChannel(chatLabel, &webrtc.DataChannelInit{Negotiated: &negotiated, ID: &id})
+	if err != nil {
+		return err
+	}
+	dc.OnOpen(u.replayChat)
+	dc.OnMessage(func(m webrtc.DataChannelMessage) {
+		u.handleChat(m.Data)
+	})
+	u.chat.Store(dc)
+	return nil
+}
+
+// handleChat сохраняет сообщение участника и рассылает его всей комнате
+func (u *User) handleChat(raw []byte) {
+	room := u.room.Load()
+	if room == nil {
+		return
+	}
+	var in chatEnvelope
+	if err := json.Unmarshal(raw, &in); err != nil || in.Type != "message" {
+		log.Println("invalid chat message from", u.ID)
+		return
+	}
+	text := strings.TrimSpace(in.Text)
+	if text == "" || utf8.RuneCountInString(text) > chatMaxLen {
+		u.sendChat(chatEnvelope{Type: "error", Code: CodeMessageInvalid, Error: fmt.Sprintf("message must be 1-%d characters", chatMaxLen)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), chatTimeout)
+	defer cancel()
+	saved, err := store.CreateMessage(ctx, room.ID, u.account, text)
+	if err != nil {
+		log.Println("save chat message:", err)
+		u.sendChat(chatEnvelope{Type: "error", Code: CodeInternal, Error: "message not saved"})
+		return
+	}
+	chatMessagesTotal.Inc()
+
+	msg := NewChatMessage(*saved)
+	room.IterateUsers(func(other *User) {
+		other.sendChat(chatEnvelope{Type: "message", Message: &msg})
+	})
+}
+
+// replayChat отправляет участнику последние chatHistory сообщений комнаты
+func (u *User) replayChat() {
+	room := u.room.Load()
+	if room == nil || chatHistory == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), chatTimeout)
+	defer cancel()
+	msgs, err := store.ListMessages(ctx, room.ID, 0, chatHistory)
+	if err != nil {
+		log.Println("load chat history:", err)
+		return
+	}
+	out := make([]ChatMessage, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, NewChatMessage(m))
+	}
+	u.sendChat(chatEnvelope{Type: "history", Messages: out})
+}
+
+// sendChat пишет сообщение в канал чата участника, если канал открыт
+func (u *User) sendChat(env chatEnvelope) {
+	dc := u.chat.Load()
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	raw, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	if err := dc.SendText(string(raw)); err != nil {
+		log.Println("chat send:", err)
+	}
+}
@@ -0,0 +1,212 @@
+package ws
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"voicechat/internal/mixer"
+)
+
+// trickleICE — режим trickle ICE: SDP (offer/answer) отправляется клиенту сразу,
+// а ICE-кандидаты сервера досылаются отдельными сообщениями candidateFromServer
+// с финальным endOfCandidates. при выключенном режиме сервер ждёт окончания
+// ICE gathering и отправляет все кандидаты внутри SDP.
+var trickleICE = true
+
+// gatheringTimeout — сколько без trickle ICE (и в WHIP/WHEP) ждём окончания ICE gathering,
+// прежде чем отправить SDP с уже собранными кандидатами
+var gatheringTimeout = 5 * time.Second
+
+// lastN — размер пула слотов пересылки, с которым комнаты создаются в БД (режим last-N, см. lastn.go);
+// дальше он хранится у комнаты и меняется через REST. 0 — режим выключен: каждый источник
+// пересылается каждому получателю отдельным треком
+var lastN = 0
+
+// настройки записи комнат (см. recorder.go)
+var (
+	// recordingsDir — каталог для файлов записей
+	recordingsDir = "recordings"
+	// recordingMix — кроме файлов участников писать сведение всей комнаты в один файл
+	recordingMix = true
+	// recordingMixFormat — формат файла сведения: ogg (Opus) или wav (PCM 16 бит)
+	recordingMixFormat = mixer.FormatOgg
+)
+
+// resumeGrace — сколько пользователь с оборванным WebSocket ждёт resume, прежде чем уйти из комнаты (см. resume.go);
+// 0 — уходит сразу
+var resumeGrace = 15 * time.Second
+
+// настройки обнаружения мёртвых участников (см. keepalive.go)
+var (
+	// pingInterval — как часто сервер шлёт ping в WebSocket
+	pingInterval = 20 * time.Second
+	// pongWait — сколько ждём от клиента pong или сообщения, прежде чем считать WebSocket оборванным;
+	// должен быть больше pingInterval
+	pongWait = 45 * time.Second
+	// iceDisconnectTimeout — сколько PeerConnection может пробыть в disconnected, прежде чем участник закроется
+	iceDisconnectTimeout = 20 * time.Second
+	// connectTimeout — за сколько после входа PeerConnection должен соединиться
+	connectTimeout = 30 * time.Second
+	// reapInterval — как часто reaper проверяет комнаты
+	reapInterval = 30 * time.Second
+)
+
+// chatHistory — сколько последних сообщений чата получает участник при входе (см. chat.go); 0 — не отправлять
+var chatHistory = 50
+
+// statsPushInterval — как часто комната рассылает участникам статистику соединений (см. stats.go); 0 — не рассылать
+var statsPushInterval = 5 * time.Second
+
+// настройки детектора речи (см. vad.go)
+var (
+	// vadThreshold — порог громкости в -dBov (RFC 6464: 0 — максимум, 127 — тишина);
+	// источник считается говорящим, когда сглаженный уровень громче -vadThreshold dBov
+	vadThreshold = 50
+	// vadSmoothing — коэффициент экспоненциального сглаживания уровня (0..1], чем больше — тем резче реакция
+	vadSmoothing = 0.3
+	// vadHold — сколько источник ещё считается говорящим после последнего громкого пакета
+	vadHold = 500 * time.Millisecond
+	// vadInterval — как часто комната пересчитывает speaking/activeSpeaker и рассылает события
+	vadInterval = 200 * time.Millisecond
+)
+
+// Init читает настройки пакета ws из переменных окружения и собирает общий webrtc.API.
+// вызывается один раз при старте сервера, до регистрации /ws.
+func Init() error {
+	// VOICECHAT_TRICKLE_ICE=false отключает trickle ICE (по умолчанию включён)
+	trickleICE = envBool("VOICECHAT_TRICKLE_ICE", trickleICE)
+	gatheringTimeout = envDuration("VOICECHAT_ICE_GATHERING_TIMEOUT", gatheringTimeout)
+
+	lastN = envInt("VOICECHAT_LAST_N", lastN)
+	if !ValidLastN(lastN) {
+		log.Printf("VOICECHAT_LAST_N must be in 0..%d, last-N disabled\n", MaxLastN)
+		lastN = 0
+	}
+
+	if v := os.Getenv("VOICECHAT_RECORDINGS_DIR"); v != "" {
+		recordingsDir = v
+	}
+	recordingMix = envBool("VOICECHAT_RECORDING_MIX", recordingMix)
+	if recordingMix && !mixer.Available {
+		log.Println("server is built without opus, recording mix disabled")
+		recordingMix = false
+	}
+	if v := os.Getenv("VOICECHAT_RECORDING_MIX_FORMAT"); v != "" {
+		if !mixer.ValidFormat(v) {
+			log.Printf("invalid VOICECHAT_RECORDING_MIX_FORMAT=%q, using %s\n", v, recordingMixFormat)
+		} else {
+			recordingMixFormat = v
+		}
+	}
+
+	// VOICECHAT_RESUME_GRACE=0 отключает возобновление сессий
+	if v := os.Getenv("VOICECHAT_RESUME_GRACE"); v == "0" {
+		resumeGrace = 0
+	} else {
+		resumeGrace = envDuration("VOICECHAT_RESUME_GRACE", resumeGrace)
+	}
+
+	pingInterval = envDuration("VOICECHAT_WS_PING_INTERVAL", pingInterval)
+	pongWait = envDuration("VOICECHAT_WS_PONG_WAIT", pongWait)
+	if pongWait <= pingInterval {
+		log.Printf("VOICECHAT_WS_PONG_WAIT must be greater than ping interval %s, using %s\n", pingInterval, 2*pingInterval)
+		pongWait = 2 * pingInterval
+	}
+	iceDisconnectTimeout = envDuration("VOICECHAT_ICE_DISCONNECT_TIMEOUT", iceDisconnectTimeout)
+	connectTimeout = envDuration("VOICECHAT_CONNECT_TIMEOUT", connectTimeout)
+	reapInterval = envDuration("VOICECHAT_REAP_INTERVAL", reapInterval)
+
+	chatHistory = envInt("VOICECHAT_CHAT_HISTORY", chatHistory)
+	if chatHistory < 0 {
+		log.Printf("VOICECHAT_CHAT_HISTORY must be >= 0, history replay disabled\n")
+		chatHistory = 0
+	}
+
+	// VOICECHAT_STATS_INTERVAL=0 отключает рассылку stats
+	if v := os.Getenv("VOICECHAT_STATS_INTERVAL"); v == "0" {
+		statsPushInterval = 0
+	} else {
+		statsPushInterval = envDuration("VOICECHAT_STATS_INTERVAL", statsPushInterval)
+	}
+
+	vadThreshold = envInt("VOICECHAT_VAD_THRESHOLD", vadThreshold)
+	if vadThreshold < 0 || vadThreshold > 127 {
+		log.Printf("VOICECHAT_VAD_THRESHOLD must be in 0..127, using 50\n")
+		vadThreshold = 50
+	}
+	vadSmoothing = envFloat("VOICECHAT_VAD_SMOOTHING", vadSmoothing)
+	if vadSmoothing <= 0 || vadSmoothing > 1 {
+		log.Printf("VOICECHAT_VAD_SMOOTHING must be in (0,1], using 0.3\n")
+		vadSmoothing = 0.3
+	}
+	vadHold = envDuration("VOICECHAT_VAD_HOLD", vadHold)
+	vadInterval = envDuration("VOICECHAT_VAD_INTERVAL", vadInterval)
+
+	a, err := newAPI()
+	if err != nil {
+		return err
+	}
+	api = a
+
+	// обход комнат: зависшие участники и пустые комнаты
+	go runReaper()
+	return nil
+}
+
+// envBool читает bool из переменной окружения, при пустом или неверном значении возвращает def
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %v\n", name, v, def)
+		return def
+	}
+	return b
+}
+
+// envInt читает целое из переменной окружения, при пустом или неверном значении возвращает def
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %d\n", name, v, def)
+		return def
+	}
+	return n
+}
+
+// envFloat читает число с плавающей точкой из переменной окружения
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %v\n", name, v, def)
+		return def
+	}
+	return f
+}
+
+// envDuration читает положительную длительность (Go duration) из переменной окружения
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("invalid %s=%q, using %s\n", name, v, def)
+		return def
+	}
+	return d
+}
@@ -2,10 +2,13 @@ package ws
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"voicechat/internal/auth"
+	"voicechat/internal/mixer"
 	"voicechat/internal/store"
 
 	"github.com/gorilla/websocket"
@@ -19,10 +22,13 @@ var upgrader = websocket.Upgrader{
 }
 
 // SignalMessage — структура сигнального сообщения, используемого для обмена данными
-// WebRTC между клиентами через сервер (join, offer, answer, candidate, leave).
+// WebRTC между клиентами через сервер (join, offer, answer, candidate, leave, error).
 // поля отражают минимальный набор данных, передаваемых в JSON-пакете.
+// типы сообщений, версия, ack и коды ошибок описаны в protocol.go.
 type SignalMessage struct {
-	Type        string          `json:"type"`           // "join","offer","answer","candidate","leave"
+	Type        string          `json:"type"`           // one of Type* (see protocol.go)
+	Version     int             `json:"v,omitempty"`    // protocol version (for join, resume, roster, resumed)
+	ID          string          `json:"id,omitempty"`   // client request id, echoed in ack/error
 	Room        string          `json:"room,omitempty"` // room id (for join)
 	From        string          `json:"from,omitempty"` // user id (optional)
 	To          string          `json:"to,omitempty"`   // target user id (optional)
@@ -31,6 +37,16 @@ type SignalMessage struct {
 	Candidate   json.RawMessage `json:"candidate,omitempty"`   // ICE candidate object (passed through)
 	DisplayName string          `json:"displayName,omitempty"` // optional nicename
 	Token       string          `json:"token,omitempty"`
+	Password    string          `json:"password,omitempty"`   // room password (for join)
+	Code        string          `json:"code,omitempty"`       // error code (for error)
+	Error       string          `json:"error,omitempty"`      // human-readable error text (for error)
+	Peers       []Participant   `json:"peers,omitempty"`      // room participants (for roster)
+	Speaking    *bool           `json:"speaking,omitempty"`   // voice activity of "from" (for speaking)
+	Slot        string          `json:"slot,omitempty"`       // forwarding slot stream id, "from" is its source (for slot)
+	Stats       *RoomStats      `json:"stats,omitempty"`      // connection stats of the room (for stats)
+	Mode        string          `json:"mode,omitempty"`       // "mixed" — receive one mixed track instead of per-source tracks (for join)
+	Session     string          `json:"session,omitempty"`    // resumable session token (for roster, resume, resumed)
+	ICERestart  bool            `json:"iceRestart,omitempty"` // client asks for an ICE restart (for resume)
 }
 
 // HandleWebSocket апгрейдит HTTP-соединение до WebSocket, выполняет аутентификацию
@@ -46,10 +62,15 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// читаем первое сообщение — оно должно быть join-сообщением
+	// читаем первое сообщение — оно должно быть join-сообщением.
+	// клиент, молчащий дольше pongWait, не должен держать горутину и сокет вечно
+	armReadDeadline(conn)
 	_, raw, err := conn.ReadMessage()
 	if err != nil {
 		log.Println("read initial ws:", err)
+		if isTimeout(err) {
+			deadPeersTotal.WithLabelValues("join_timeout").Inc()
+		}
 		_ = conn.Close()
 		return
 	}
@@ -58,21 +79,41 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	var msg SignalMessage
 	if err := json.Unmarshal(raw, &msg); err != nil {
 		log.Println("invalid initial msg:", err)
-		_ = conn.Close()
+		rejectJoin(conn, "", CodeBadRequest, "invalid JSON")
+		return
+	}
+
+	// join без версии — клиент версии 1; более новую версию сервер не понимает
+	if msg.Version > ProtocolVersion {
+		log.Printf("unsupported protocol version %d\n", msg.Version)
+		rejectJoin(conn, msg.ID, CodeUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported, server speaks %d", msg.Version, ProtocolVersion))
+		return
+	}
+
+	// возобновление сессии после обрыва WebSocket (см. resume.go)
+	if msg.Type == TypeResume {
+		resumeSession(conn, msg)
 		return
 	}
 
 	// проверяем, что первое сообщение join и комната указана
-	if msg.Type != "join" || msg.Room == "" {
+	if msg.Type != TypeJoin || msg.Room == "" {
 		log.Println("first message must be join with non-empty room")
-		_ = conn.Close()
+		rejectJoin(conn, msg.ID, CodeJoinRequired, "first message must be join with non-empty room")
+		return
+	}
+
+	// сведение работает только в сборке с Opus (тег opus, см. internal/mixer)
+	if msg.Mode == ModeMixed && !mixer.Available {
+		log.Println("join in mixed mode, but server is built without opus")
+		rejectJoin(conn, msg.ID, CodeMixUnavailable, "mixed mode is not available on this server")
 		return
 	}
 
 	// проверяем, что клиент передал JWT-токен
 	if msg.Token == "" {
 		log.Println("join without token: unauthorized")
-		_ = conn.Close()
+		rejectJoin(conn, msg.ID, CodeUnauthorized, "token required")
 		return
 	}
 
@@ -80,53 +121,99 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	uid, _, err := auth.ParseToken(msg.Token)
 	if err != nil {
 		log.Println("invalid token:", err)
-		_ = conn.Close()
+		rejectJoin(conn, msg.ID, CodeUnauthorized, "invalid token")
 		return
 	}
 
 	// загружаем профиль/запись пользователя из БД, полученная по userID, который мы извлекли из JWT-токена.
 	prof, err := store.GetUserByID(r.Context(), uid)
-	if err != nil || prof == nil {
+	if err != nil {
+		log.Println("user lookup:", err)
+		rejectJoin(conn, msg.ID, CodeInternal, "user lookup failed")
+		return
+	}
+	if prof == nil {
 		log.Println("user not found for token")
-		_ = conn.Close()
+		rejectJoin(conn, msg.ID, CodeUnauthorized, "user not found")
 		return
 	}
 
-	// получаем существующую комнату или создаём новую
-	room := GetOrCreateRoom(msg.Room)
+	// проверяем права на вход в комнату (владелец, видимость, пароль, участники)
+	settings, perr := authorizeJoin(r.Context(), msg.Room, uid, msg.Password)
+	if perr != nil {
+		log.Printf("❌ REJECTED: user \"%s\" (id=%s) room %s: %v\n", prof.DisplayName, uid, msg.Room, perr)
+		rejectJoin(conn, msg.ID, perr.Code, perr.Message)
+		return
+	}
+
+	// клиент зашёл заново, не дождавшись resume (например, потерял токен сессии) —
+	// старая оборванная сессия больше не нужна. делаем это до входа в комнату:
+	// если старая сессия была последней, комната удалится
+	if active := LookupRoom(msg.Room); active != nil {
+		if old := active.GetUser(uid); old != nil && old.isDetached() {
+			old.Close()
+		}
+	}
 
 	// проверяем, что пользователь ещё не подключён к этой комнате
-	if room.HasUser(uid) {
+	if active := LookupRoom(msg.Room); active != nil && active.HasUser(uid) {
 		log.Printf("❌ BLOCKED: user \"%s\" (id=%s) already in room %s\n", prof.DisplayName, uid, msg.Room)
-		_ = conn.Close()
+		rejectJoin(conn, msg.ID, CodeAlreadyJoined, "already in room")
 		return
 	}
 
-	// создаём объект пользователя, привязанный к WebSocket и комнате
-	user := NewUser(conn, room)
+	// создаём объект пользователя, привязанный к WebSocket; комнату он получит в AddUser
+	user := NewUser(conn, nil)
 
 	// устанавливаем отображаемое имя из профиля в БД
 	user.DisplayName = prof.DisplayName
 	// используем ID пользователя из JWT как идентификатор подключения
 	user.ID = uid
-
-	// перед добавлением пользователя в комнату проверяем, есть ли он там, предотвращая гонку
-	if !room.AddUser(user) {
+	user.account = uid
+	// режим приёма выбирается один раз при входе: отдельные треки или сведение (см. mcu.go)
+	user.mixed = msg.Mode == ModeMixed
+	// токен возобновления уходит клиенту в roster
+	user.session = newSessionToken()
+
+	// добавляем в комнату (если её нет — создаём с настройками из БД); AddUser атомарно
+	// повторяет проверку, что пользователя там нет, предотвращая гонку
+	if err := joinRoom(user, msg.Room, settings.LastN); err != nil {
 		log.Printf("❌ BLOCKED (race): user \"%s\" (id=%s) already in room %s\n", prof.DisplayName, uid, msg.Room)
-		_ = conn.Close()
+		rejectJoin(conn, msg.ID, CodeAlreadyJoined, "already in room")
 		return
 	}
 	log.Printf("✅ ALLOWED: user \"%s\" (id=%s) joining room %s\n", prof.DisplayName, uid, msg.Room)
+	joinsTotal.Inc()
+	rememberSession(user)
+
+	// запускаем единственного писателя в WebSocket — все сигнальные сообщения идут через очередь user.Send
+	go user.WritePump(conn, user.connDone)
 
 	// если клиент сразу прислал SDP offer — принимаем его и отправляем answer
 	if msg.SDP != "" && msg.SDPType == "offer" {
 		if err := user.ReceiveOfferAndAnswerBack(msg.SDP); err != nil {
 			log.Println("handle initial offer:", err)
+			// ошибка уйдёт клиенту до close-фрейма: WritePump дописывает очередь при закрытии
+			user.reply(msg, &ProtocolError{Code: CodeOfferFailed, Message: "offer rejected"})
 			user.Close()
 			return
 		}
 	}
+	// вход подтверждён: roster (и answer) уже в очереди
+	user.reply(msg, nil)
 
 	// запускаем горутину для чтения сообщений от клиента
-	go user.ReadPump()
+	go user.ReadPump(conn)
+}
+
+// rejectJoin отправляет клиенту типизированную ошибку на первое сообщение (id — его id запроса),
+// учитывает отказ в joinRejectionsTotal и закрывает соединение. вызывается до создания User,
+// поэтому пишет в conn напрямую (конкурентных писателей ещё нет).
+func rejectJoin(conn *websocket.Conn, id, code, text string) {
+	joinRejectionsTotal.WithLabelValues(code).Inc()
+	_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_ = conn.WriteJSON(SignalMessage{Type: TypeError, ID: id, Code: code, Error: text})
+	// корректный close-фрейм, чтобы клиент успел прочитать ошибку до закрытия
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, code))
+	_ = conn.Close()
 }
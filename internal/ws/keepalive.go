@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// обнаружение мёртвых участников. без него полуоткрытые TCP-соединения и клиенты
+// с умершим ICE висят в комнате бесконечно:
+//   - WebSocket: сервер шлёт ping раз в pingInterval, клиент (браузер сам) отвечает pong;
+//     если за pongWait не пришло ни pong, ни сообщения, чтение падает по дедлайну
+//     и соединение отвязывается как при обрыве (участник ждёт resume, см. resume.go);
+//     тот же дедлайн ограничивает ожидание первого сообщения (join/resume) после апгрейда;
+//   - WebRTC: участник закрывается при PeerConnection failed и после iceDisconnectTimeout
+//     непрерывного disconnected — это единственная проверка для WHIP/WHEP без WebSocket;
+//     у участника, ждущего resume, ICE чинится перезапуском после resume, а не закрытием;
+//   - reaper раз в reapInterval обходит комнаты: закрывает участников, чей PeerConnection
+//     так и не соединился за connectTimeout, и убирает пустые комнаты.
+
+// armReadDeadline продлевает дедлайн чтения conn: клиент жив, пока присылает сообщения или pong
+func armReadDeadline(conn *websocket.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+}
+
+// watchPongs ставит начальный дедлайн чтения conn и продлевает его на каждый pong
+func watchPongs(conn *websocket.Conn) {
+	armReadDeadline(conn)
+	conn.SetPongHandler(func(string) error {
+		armReadDeadline(conn)
+		return nil
+	})
+}
+
+// isTimeout сообщает, что чтение WebSocket прервано дедлайном (pong не пришёл)
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// ping отправляет клиенту ping; пишет только WritePump, поэтому WriteControl без блокировок
+func ping(conn *websocket.Conn) error {
+	return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
+
+// onConnectionStateChange следит за PeerConnection участника:
+// failed закрывает его сразу, disconnected — если соединение не восстановилось за iceDisconnectTimeout.
+// пока WebSocket оборван и участник ждёт resume, не закрывает: судьбу участника решает
+// grace period, а при resume сервер перезапускает ICE (см. resume.go)
+func (u *User) onConnectionStateChange(pc *webrtc.PeerConnection, s webrtc.PeerConnectionState) {
+	log.Printf("user %s: peer connection %s\n", u.ID, s)
+
+	u.iceMtx.Lock()
+	defer u.iceMtx.Unlock()
+	if u.iceTimer != nil {
+		u.iceTimer.Stop()
+		u.iceTimer = nil
+	}
+	switch s {
+	case webrtc.PeerConnectionStateConnected:
+		u.connected.Store(true)
+	case webrtc.PeerConnectionStateFailed:
+		if u.isDetached() {
+			log.Printf("user %s: peer connection failed while detached, waiting for resume\n", u.ID)
+			return
+		}
+		deadPeersTotal.WithLabelValues("ice_failed").Inc()
+		// колбэк pion: Close закрывает этот же PeerConnection, поэтому не здесь
+		go u.Close()
+	case webrtc.PeerConnectionStateDisconnected:
+		u.iceTimer = time.AfterFunc(iceDisconnectTimeout, func() {
+			if pc.ConnectionState() != webrtc.PeerConnectionStateDisconnected || u.isDetached() {
+				return
+			}
+			log.Printf("user %s: peer connection disconnected for %s, closing\n", u.ID, iceDisconnectTimeout)
+			deadPeersTotal.WithLabelValues("ice_disconnected").Inc()
+			u.Close()
+		})
+	}
+}
+
+// stopICETimer останавливает ожидание восстановления disconnected при закрытии участника
+func (u *User) stopICETimer() {
+	u.iceMtx.Lock()
+	defer u.iceMtx.Unlock()
+	if u.iceTimer != nil {
+		u.iceTimer.Stop()
+		u.iceTimer = nil
+	}
+}
+
+// runReaper раз в reapInterval проверяет все комнаты (см. Room.reap)
+func runReaper() {
+	t := time.NewTicker(reapInterval)
+	defer t.Stop()
+	for range t.C {
+		roomsMtx.RLock()
+		rs := make([]*Room, 0, len(rooms))
+		for _, r := range rooms {
+			rs = append(rs, r)
+		}
+		roomsMtx.RUnlock()
+
+		for _, r := range rs {
+			r.reap()
+		}
+	}
+}
+
+// reap закрывает участников, которые так и не установили WebRTC-соединение за connectTimeout,
+// и удаляет комнату, если в ней никого нет
+func (r *Room) reap() {
+	r.IterateUsers(func(u *User) {
+		if !u.connected.Load() && time.Since(u.createdAt) > connectTimeout {
+			log.Printf("user %s: no peer connection after %s, closing\n", u.ID, connectTimeout)
+			deadPeersTotal.WithLabelValues("connect_timeout").Inc()
+			u.Close()
+		}
+	})
+
+	// пустая комната могла остаться, если вход в неё сорвался после GetOrCreateRoom;
+	// только что созданную не трогаем — в неё как раз входят
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if len(r.users) > 0 || time.Since(r.created) < reapInterval {
+		return
+	}
+	roomsMtx.Lock()
+	removed := rooms[r.ID] == r
+	if removed {
+		delete(rooms, r.ID)
+	}
+	roomsMtx.Unlock()
+	if removed {
+		close(r.done)
+		log.Printf("room %s removed by reaper (empty)\n", r.ID)
+	}
+}
@@ -0,0 +1,285 @@
+package ws
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// режим last-N: вместо отдельного трека на каждый источник у получателя есть
+// фиксированный пул из N слотов (TrackLocalStaticRTP), за которыми сервер переключает
+// самых активных говорящих. набор треков не меняется, поэтому переключение
+// источника не требует renegotiation, а трафик получателя ограничен N потоками.
+
+// slotCodec — кодек слотов: набор треков создаётся до того, как известны источники,
+// поэтому слоты рассчитаны на Opus (кодек браузеров по умолчанию)
+var slotCodec = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeOpus,
+	ClockRate:   48000,
+	Channels:    2,
+	SDPFmtpLine: "minptime=10;useinbandfec=1",
+}
+
+// slottable сообщает, можно ли пересылать источник с кодеком codec через слоты:
+// пакеты пишутся в трек слота как есть, поэтому кодек источника должен совпадать с slotCodec
+func slottable(codec webrtc.RTPCodecParameters) bool {
+	return strings.EqualFold(codec.MimeType, slotCodec.MimeType) && codec.ClockRate == slotCodec.ClockRate
+}
+
+// slotFrameTicks — минимальный шаг RTP timestamp при переключении источника (20 мс Opus)
+const slotFrameTicks = 960
+
+// MaxLastN — наибольший размер пула слотов: каждый слот — отдельный трек у каждого получателя
+const MaxLastN = 32
+
+// ValidLastN сообщает, допустим ли размер пула слотов n (0 — last-N выключен)
+func ValidLastN(n int) bool {
+	return n >= 0 && n <= MaxLastN
+}
+
+// DefaultLastN возвращает размер пула слотов для новых комнат (VOICECHAT_LAST_N)
+func DefaultLastN() int {
+	return lastN
+}
+
+// forwardSlot — один слот пересылки у получателя.
+// при смене источника seq и timestamp переписываются так, чтобы для клиента
+// поток оставался непрерывным: у разных источников свои независимые счётчики.
+type forwardSlot struct {
+	id     string // stream id трека слота, по нему клиент сопоставляет слот и источник
+	track  *webrtc.TrackLocalStaticRTP
+	sender *webrtc.RTPSender
+
+	mtx       sync.Mutex
+	src       string // id источника за слотом, "" — слот свободен
+	switched  bool   // источник сменился, смещения пересчитываются на первом пакете
+	started   bool   // в слот уже писались пакеты
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+}
+
+// source возвращает id источника за слотом
+func (s *forwardSlot) source() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.src
+}
+
+// assign ставит за слот источник src ("" — освободить слот)
+func (s *forwardSlot) assign(src string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.src = src
+	s.switched = true
+}
+
+// write пишет пакет источника src в слот, если за слотом сейчас этот источник.
+// возвращает false, если слот занят другим источником
+func (s *forwardSlot) write(src string, pkt *rtp.Packet) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.src != src {
+		return false, nil
+	}
+	now := time.Now()
+	if s.switched {
+		s.switched = false
+		if s.started {
+			// продолжаем нумерацию с последнего отправленного пакета, timestamp сдвигаем на прошедшее время
+			ticks := uint32(now.Sub(s.lastWrite).Seconds() * float64(slotCodec.ClockRate))
+			if ticks < slotFrameTicks {
+				ticks = slotFrameTicks
+			}
+			s.seqOffset = s.lastSeq + 1 - pkt.SequenceNumber
+			s.tsOffset = s.lastTS + ticks - pkt.Timestamp
+		}
+	}
+
+	// pkt общий для всех получателей — переписываем копию заголовка
+	out := *pkt
+	out.SequenceNumber += s.seqOffset
+	out.Timestamp += s.tsOffset
+	s.lastSeq, s.lastTS, s.lastWrite, s.started = out.SequenceNumber, out.Timestamp, now, true
+	return true, s.track.WriteRTP(&out)
+}
+
+// addSlots создаёт у получателя пул из n слотов и добавляет их треки в PeerConnection.
+// возвращает true, если слоты добавлены и нужна renegotiation. при ошибке уже добавленные
+// треки снимаются: PeerConnection остаётся без слотов, а не с частью пула без пересылки
+func (u *User) addSlots(n int) bool {
+	pc := u.pc.Load()
+	if pc == nil {
+		log.Printf("skip adding slots for user %s: PC not ready\n", u.ID)
+		return false
+	}
+
+	u.outMtx.Lock()
+	defer u.outMtx.Unlock()
+	if u.slots != nil {
+		return false
+	}
+	slots := make([]*forwardSlot, 0, n)
+	for i := 0; i < n; i++ {
+		id := "slot-" + strconv.Itoa(i)
+		track, err := webrtc.NewTrackLocalStaticRTP(slotCodec, "audio", id)
+		if err != nil {
+			log.Println("create slot track:", err)
+			u.removeSlotSenders(slots)
+			return false
+		}
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			log.Println("PC.AddTrack (slot) error:", err)
+			u.removeSlotSenders(slots)
+			return false
+		}
+		slots = append(slots, &forwardSlot{id: id, track: track, sender: sender})
+	}
+	// RTCP читаем, только когда весь пул на месте
+	for _, slot := range slots {
+		// статистика пути ведётся по слоту, PLI уходит тому, кто сейчас за слотом
+		go u.readSenderRTCP(slot.id, slot.sender, slotCodec.ClockRate, slot.source)
+	}
+	u.slots = slots
+	return true
+}
+
+// removeSlotSenders снимает с PeerConnection треки недособранного пула слотов
+func (u *User) removeSlotSenders(slots []*forwardSlot) {
+	for _, s := range slots {
+		if err := u.pc.Load().RemoveTrack(s.sender); err != nil {
+			log.Println("PC.RemoveTrack (slot) error:", err)
+		}
+	}
+}
+
+// forward пересылает пакет источника srcID этому получателю:
+// в режиме last-N — в слот, за которым стоит источник, иначе — в его отдельный трек.
+// источник вне top-N в режиме last-N — штатная фильтрация (reason last_n), а не сбой маршрутизации
+func (u *User) forward(srcID string, pkt *rtp.Packet) {
+	u.outMtx.RLock()
+	slots := u.slots
+	tr := u.outgoing[srcID]
+	u.outMtx.RUnlock()
+
+	for _, s := range slots {
+		ok, err := s.write(srcID, pkt)
+		if ok {
+			countForwarded(pkt, err)
+			return
+		}
+	}
+	if slots != nil {
+		rtpPacketsDropped.WithLabelValues("last_n").Inc()
+		return
+	}
+	// если смогли взять трек, пишем в него rtp-пакеты
+	if tr == nil {
+		rtpPacketsDropped.WithLabelValues("no_route").Inc()
+		return
+	}
+	countForwarded(pkt, tr.WriteRTP(pkt))
+}
+
+// countForwarded учитывает в метриках результат записи пакета получателю
+func countForwarded(pkt *rtp.Packet, err error) {
+	if err != nil {
+		log.Println("WriteRTP error:", err)
+		rtpWriteErrors.Inc()
+		return
+	}
+	rtpPacketsForwarded.Inc()
+	rtpBytesForwarded.Add(float64(pkt.MarshalSize()))
+}
+
+// rankSources упорядочивает источники комнаты для last-N: сначала говорящие
+// по громкости, затем остальные по давности последней речи. заглушённые не участвуют.
+// порядок молчащих меняется только когда кто-то говорит, поэтому слоты не «дребезжат».
+func rankSources(states map[string]speakerState) []string {
+	ids := make([]string, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := states[ids[i]], states[ids[j]]
+		if a.speaking != b.speaking {
+			return a.speaking
+		}
+		if a.speaking && a.loudness != b.loudness {
+			return a.loudness > b.loudness
+		}
+		if !a.lastVoice.Equal(b.lastVoice) {
+			return a.lastVoice.After(b.lastVoice)
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// assignSlots раскладывает top-N источников по слотам получателя u.
+// источник, уже стоящий в слоте и оставшийся в top-N, слот не меняет;
+// освободившиеся слоты занимают новые источники. о каждой смене клиенту уходит
+// {type:"slot", slot, from} (from пустой — слот свободен).
+func (u *User) assignSlots(ranked []string) {
+	u.outMtx.RLock()
+	slots := u.slots
+	u.outMtx.RUnlock()
+	if len(slots) == 0 {
+		return
+	}
+
+	// top-N без самого получателя
+	top := make(map[string]bool, len(slots))
+	var order []string
+	for _, id := range ranked {
+		if len(order) == len(slots) {
+			break
+		}
+		if id == u.ID {
+			continue
+		}
+		top[id] = true
+		order = append(order, id)
+	}
+
+	// оставляем на месте тех, кто уже в слотах и остаётся в top-N
+	placed := make(map[string]bool, len(slots))
+	var free []*forwardSlot
+	for _, s := range slots {
+		if src := s.source(); src != "" && top[src] && !placed[src] {
+			placed[src] = true
+			continue
+		}
+		free = append(free, s)
+	}
+	// в освободившиеся слоты — новые источники по порядку ранга, остальные слоты очищаем
+	for _, id := range order {
+		if placed[id] || len(free) == 0 {
+			continue
+		}
+		s := free[0]
+		free = free[1:]
+		u.setSlot(s, id)
+	}
+	for _, s := range free {
+		u.setSlot(s, "")
+	}
+}
+
+// setSlot меняет источник слота и сообщает об этом клиенту
+func (u *User) setSlot(s *forwardSlot, src string) {
+	if s.source() == src {
+		return
+	}
+	s.assign(src)
+	_ = u.Send(SignalMessage{Type: TypeSlot, Slot: s.id, From: src})
+}
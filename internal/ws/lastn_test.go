@@ -0,0 +1,122 @@
+package ws
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRankSources(t *testing.T) {
+	now := time.Now()
+	states := map[string]speakerState{
+		"quiet-old":    {lastVoice: now.Add(-time.Minute)},
+		"loud":         {speaking: true, loudness: 0.9, lastVoice: now},
+		"quiet-recent": {lastVoice: now.Add(-time.Second)},
+		"soft":         {speaking: true, loudness: 0.2, lastVoice: now},
+		"never-b":      {},
+		"never-a":      {},
+	}
+	want := []string{"loud", "soft", "quiet-recent", "quiet-old", "never-a", "never-b"}
+	if got := rankSources(states); !reflect.DeepEqual(got, want) {
+		t.Errorf("rankSources = %v, want %v", got, want)
+	}
+}
+
+// slotUser — получатель с n пустыми слотами (без PeerConnection: assignSlots треки не трогает)
+func slotUser(id string, n int) *User {
+	u := NewUser(nil, nil)
+	u.ID = id
+	for i := 0; i < n; i++ {
+		u.slots = append(u.slots, &forwardSlot{id: "slot-" + strconv.Itoa(i)})
+	}
+	return u
+}
+
+func slotSources(u *User) []string {
+	srcs := make([]string, len(u.slots))
+	for i, s := range u.slots {
+		srcs[i] = s.source()
+	}
+	return srcs
+}
+
+func TestAssignSlots(t *testing.T) {
+	u := slotUser("me", 2)
+
+	// получатель не попадает в свои слоты
+	u.assignSlots([]string{"me", "a", "b", "c"})
+	if got, want := slotSources(u), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("slots = %v, want %v", got, want)
+	}
+	want := []SignalMessage{
+		{Type: TypeSlot, Slot: "slot-0", From: "a"},
+		{Type: TypeSlot, Slot: "slot-1", From: "b"},
+	}
+	if msgs := sent(u); !reflect.DeepEqual(msgs, want) {
+		t.Errorf("sent %+v, want %+v", msgs, want)
+	}
+
+	// b остаётся в top-N и не меняет слот, хоть и поднялся в ранге; место a занимает c
+	u.assignSlots([]string{"b", "c", "a"})
+	if got, want := slotSources(u), []string{"c", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("slots = %v, want %v", got, want)
+	}
+	want = []SignalMessage{{Type: TypeSlot, Slot: "slot-0", From: "c"}}
+	if msgs := sent(u); !reflect.DeepEqual(msgs, want) {
+		t.Errorf("sent %+v, want %+v", msgs, want)
+	}
+
+	// тот же ранг — ни смен, ни сообщений
+	u.assignSlots([]string{"b", "c", "a"})
+	if msgs := sent(u); len(msgs) != 0 {
+		t.Errorf("unchanged ranking sent %+v", msgs)
+	}
+
+	// источников меньше, чем слотов — лишний слот освобождается
+	u.assignSlots([]string{"me", "b"})
+	if got, want := slotSources(u), []string{"", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("slots = %v, want %v", got, want)
+	}
+	want = []SignalMessage{{Type: TypeSlot, Slot: "slot-0"}}
+	if msgs := sent(u); !reflect.DeepEqual(msgs, want) {
+		t.Errorf("sent %+v, want %+v", msgs, want)
+	}
+}
+
+func TestSlottable(t *testing.T) {
+	tests := []struct {
+		codec webrtc.RTPCodecParameters
+		want  bool
+	}{
+		{webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/opus", ClockRate: 48000, Channels: 2}}, true},
+		{webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}}, false},
+		{webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000}}, false},
+	}
+	for _, tt := range tests {
+		if got := slottable(tt.codec); got != tt.want {
+			t.Errorf("slottable(%s) = %v, want %v", tt.codec.MimeType, got, tt.want)
+		}
+	}
+}
+
+func TestForwardOutsideTopN(t *testing.T) {
+	u := slotUser("me", 1)
+	u.slots[0].assign("a")
+	lastN := rtpPacketsDropped.WithLabelValues("last_n")
+	noRoute := rtpPacketsDropped.WithLabelValues("no_route")
+	before, beforeNoRoute := testutil.ToFloat64(lastN), testutil.ToFloat64(noRoute)
+
+	// b не в слотах — это фильтрация last-N, а не потерянный маршрут
+	u.forward("b", &rtp.Packet{})
+	if got := testutil.ToFloat64(lastN) - before; got != 1 {
+		t.Errorf("last_n drops = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(noRoute) - beforeNoRoute; got != 0 {
+		t.Errorf("no_route drops = %v, want 0", got)
+	}
+}
@@ -0,0 +1,197 @@
+package ws
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"voicechat/internal/mixer"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// режим mixed (MCU): для клиентов на плохих каналах сервер вместо N-1 треков
+// присылает один Opus-трек со сведением всех остальных участников без голоса
+// самого получателя (mix-minus). режим выбирается клиентом в join ("mode":"mixed").
+// сведение комнаты работает, только пока в ней есть хотя бы один такой получатель
+// или записывается сведение (см. recorder.go): декодирование всех источников не бесплатно,
+// поэтому оба потребителя берут кадры из одного микшера и каждый источник декодируется один раз.
+
+// ModeMixed — значение поля mode в join для подписки на сведённый звук
+const ModeMixed = "mixed"
+
+// mixStreamID — stream id трека сведения у получателя
+const mixStreamID = "mix"
+
+// mixCodec — кодек трека сведения (Opus, как и слоты last-N)
+var mixCodec = slotCodec
+
+// roomMix — сведение комнаты для получателей в режиме mixed и файла сведения записи
+type roomMix struct {
+	mixer *mixer.Mixer
+	stop  chan struct{}
+
+	// поля ниже защищены mtx комнаты
+	// receivers — в комнате есть получатели в режиме mixed
+	receivers bool
+	// rec — файл сведения идущей записи, nil — сведение не записывается
+	rec *mixRecorder
+}
+
+// mixedOutput — трек сведения получателя и его Opus-кодер.
+// у каждого получателя свой кодер: mix-minus у всех разный
+type mixedOutput struct {
+	track  *webrtc.TrackLocalStaticRTP
+	sender *webrtc.RTPSender
+
+	mtx sync.Mutex // кодер не потокобезопасен, а тикер сведения может смениться
+	enc *mixer.Encoder
+	pcm []float32
+}
+
+// activeMix возвращает сведение комнаты или nil, если оно никому не нужно
+func (r *Room) activeMix() *roomMix {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.mix
+}
+
+// startMixLocked возвращает сведение комнаты, запуская его, если оно ещё не идёт. вызывается под r.mtx
+func (r *Room) startMixLocked() *roomMix {
+	if r.mix == nil {
+		r.mix = &roomMix{mixer: mixer.New(), stop: make(chan struct{})}
+		log.Printf("room %s: mixing started\n", r.ID)
+		go r.runMix(r.mix)
+	}
+	return r.mix
+}
+
+// stopMixLocked останавливает сведение, если не осталось ни получателей, ни записи. вызывается под r.mtx
+func (r *Room) stopMixLocked() {
+	m := r.mix
+	if m == nil || m.receivers || m.rec != nil {
+		return
+	}
+	r.mix = nil
+	close(m.stop)
+	log.Printf("room %s: mixing stopped\n", r.ID)
+}
+
+// attachMix запускает сведение комнаты для получателя u, если оно ещё не идёт
+func (r *Room) attachMix(u *User) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	// u мог уже уйти (releaseMix отработал раньше) — тогда сведение не нужно
+	if r.users[u.ID] != u {
+		return
+	}
+	r.startMixLocked().receivers = true
+}
+
+// releaseMix убирает ушедшего участника из сведения и останавливает сведение,
+// если среди оставшихся rest не осталось получателей в режиме mixed и сведение не записывается
+func (r *Room) releaseMix(u *User, rest []*User) {
+	r.mtx.Lock()
+	m := r.mix
+	if m == nil {
+		r.mtx.Unlock()
+		return
+	}
+	m.receivers = false
+	for _, other := range rest {
+		if other.mixed {
+			m.receivers = true
+			break
+		}
+	}
+	r.stopMixLocked()
+	r.mtx.Unlock()
+
+	m.mixer.Remove(u.ID)
+}
+
+// runMix раз в 20 мс сводит источники комнаты, пишет кадр в файл сведения записи
+// и рассылает каждому получателю в режиме mixed его mix-minus.
+// останавливается вместе с комнатой или stopMixLocked
+func (r *Room) runMix(m *roomMix) {
+	t := time.NewTicker(time.Second * mixer.FrameSamples / mixer.SampleRate)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-m.stop:
+			return
+		case <-t.C:
+			frame := m.mixer.Mix()
+			r.mtx.RLock()
+			rec := m.rec
+			r.mtx.RUnlock()
+			if rec != nil {
+				rec.write(frame.Sum)
+			}
+			r.IterateUsers(func(u *User) {
+				u.writeMix(frame)
+			})
+		}
+	}
+}
+
+// addMixTrack создаёт у получателя трек сведения и добавляет его в PeerConnection.
+// возвращает true, если трек добавлен и нужна renegotiation
+func (u *User) addMixTrack() bool {
+	pc := u.pc.Load()
+	if pc == nil {
+		log.Printf("skip adding mix track for user %s: PC not ready\n", u.ID)
+		return false
+	}
+
+	u.outMtx.Lock()
+	defer u.outMtx.Unlock()
+	if u.mixOut != nil {
+		return false
+	}
+	enc, err := mixer.NewEncoder()
+	if err != nil {
+		log.Println("create mix encoder:", err)
+		return false
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(mixCodec, "audio", mixStreamID)
+	if err != nil {
+		log.Println("create mix track:", err)
+		return false
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		log.Println("PC.AddTrack (mix) error:", err)
+		return false
+	}
+	u.mixOut = &mixedOutput{track: track, sender: sender, enc: enc, pcm: make([]float32, mixer.FrameSamples)}
+	// статистика пути — по треку сведения; PLI для звука не нужен, источника у трека нет
+	go u.readSenderRTCP(mixStreamID, sender, mixCodec.ClockRate, func() string { return "" })
+	return true
+}
+
+// writeMix кодирует кадр сведения без голоса самого получателя и отправляет его клиенту
+func (u *User) writeMix(frame mixer.Frame) {
+	u.outMtx.RLock()
+	out := u.mixOut
+	u.outMtx.RUnlock()
+	if out == nil {
+		return
+	}
+
+	out.mtx.Lock()
+	defer out.mtx.Unlock()
+	frame.Without(u.ID, out.pcm)
+	pkt, err := out.enc.Encode(out.pcm)
+	if err != nil {
+		log.Println("mix encode:", err)
+		return
+	}
+	// кодер ещё набирает lookahead
+	if pkt == nil {
+		return
+	}
+	countForwarded(pkt, out.track.WriteRTP(pkt))
+}
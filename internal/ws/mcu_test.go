@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"voicechat/internal/mixer"
+
+	"github.com/gorilla/websocket"
+)
+
+// сведение одно на комнату и живёт, пока нужно получателям mixed или записи
+func TestMixLifecycle(t *testing.T) {
+	r := GetOrCreateRoom("mix-room", 0)
+	defer closeRoom(r)
+
+	r.mtx.Lock()
+	m := r.startMixLocked()
+	if again := r.startMixLocked(); again != m {
+		t.Error("second consumer started another mix")
+	}
+	m.receivers = true
+	m.rec = &mixRecorder{}
+
+	// получатели ушли — запись всё ещё пишет сведение
+	m.receivers = false
+	r.stopMixLocked()
+	if r.mix != m {
+		t.Error("mix stopped while recording")
+	}
+	m.rec = nil
+	r.stopMixLocked()
+	stopped := r.mix == nil
+	r.mtx.Unlock()
+
+	if !stopped {
+		t.Fatal("mix still running without consumers")
+	}
+	select {
+	case <-m.stop:
+	default:
+		t.Error("mix ticker not stopped")
+	}
+}
+
+func TestMixedUnavailableWithoutOpus(t *testing.T) {
+	if mixer.Available {
+		t.Skip("built with opus")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer srv.Close()
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.WriteJSON(SignalMessage{Type: TypeJoin, ID: "1", Room: "r", Token: "t", Mode: ModeMixed}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readSignal(t, client); msg.Type != TypeError || msg.ID != "1" || msg.Code != CodeMixUnavailable {
+		t.Errorf("mixed join: %+v, want error %s", msg, CodeMixUnavailable)
+	}
+
+	if _, _, err := StartWHEP(context.Background(), "r", "42", "v=0"); !errors.Is(err, ErrMixUnavailable) {
+		t.Errorf("StartWHEP: %v, want ErrMixUnavailable", err)
+	}
+}
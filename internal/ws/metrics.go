@@ -0,0 +1,93 @@
+package ws
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// метрики Prometheus сигналинга и SFU, отдаются на /metrics (см. cmd/server)
+var (
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "voicechat_rooms_active",
+		Help: "Rooms with at least one connected user.",
+	}, func() float64 {
+		roomsMtx.RLock()
+		defer roomsMtx.RUnlock()
+		return float64(len(rooms))
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "voicechat_users_active",
+		Help: "Users connected to rooms.",
+	}, func() float64 {
+		n := 0
+		for _, info := range ListRooms() {
+			n += info.Participants
+		}
+		return float64(n)
+	})
+
+	joinsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voicechat_joins_total",
+		Help: "Users admitted to a room.",
+	})
+
+	leavesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voicechat_leaves_total",
+		Help: "Users removed from a room (leave, disconnect, kick).",
+	})
+
+	// reason — код ошибки на первое сообщение join/resume (room_forbidden, already_joined, unauthorized,
+	// session_expired, ...; см. rejectJoin) или отказа WHIP/WHEP
+	joinRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voicechat_join_rejections_total",
+		Help: "Join attempts rejected, by reason.",
+	}, []string{"reason"})
+
+	// op — offer (серверный offer), answer (ответ на offer клиента), remote_answer (answer клиента)
+	negotiationFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voicechat_negotiation_failures_total",
+		Help: "SDP negotiation steps that failed, by operation.",
+	}, []string{"op"})
+
+	rtpPacketsForwarded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voicechat_rtp_packets_forwarded_total",
+		Help: "RTP packets written to receivers' tracks.",
+	})
+
+	rtpBytesForwarded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voicechat_rtp_bytes_forwarded_total",
+		Help: "RTP bytes (header and payload) written to receivers' tracks.",
+	})
+
+	// reason — muted (источник заглушён модератором), last_n (источник не в top-N получателя или
+	// его кодек не подходит для слотов) или no_route (у получателя нет трека для источника)
+	rtpPacketsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voicechat_rtp_packets_dropped_total",
+		Help: "RTP packets read from a source and not forwarded, by reason.",
+	}, []string{"reason"})
+
+	rtpWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voicechat_rtp_write_errors_total",
+		Help: "WriteRTP errors while forwarding.",
+	})
+
+	// reason — pong_timeout (WebSocket молчит дольше pongWait), ice_failed, ice_disconnected,
+	// connect_timeout (PeerConnection не соединился после входа),
+	// join_timeout (WebSocket открыт, но первое сообщение не пришло за pongWait)
+	deadPeersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voicechat_dead_peers_total",
+		Help: "Users dropped by keepalive and dead-peer detection, by reason.",
+	}, []string{"reason"})
+
+	// result — ok, expired (нет сессии или истёк grace period) или unauthorized (неверный JWT)
+	sessionResumesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voicechat_session_resumes_total",
+		Help: "WebSocket session resume attempts, by result.",
+	}, []string{"result"})
+
+	chatMessagesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voicechat_chat_messages_total",
+		Help: "Chat messages saved and relayed to a room.",
+	})
+)
@@ -0,0 +1,108 @@
+package ws
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"voicechat/internal/store"
+)
+
+// коды ошибок команд модерации
+const (
+	CodeForbidden      = "forbidden"        // у отправителя нет прав модератора или цель нельзя модерировать
+	CodeUserNotInRoom  = "user_not_in_room" // цели нет в комнате
+	CodeInvalidMessage = "invalid_message"  // в сообщении не хватает полей
+)
+
+// moderationTimeout — ограничение на запросы к БД при обработке команды модератора
+const moderationTimeout = 5 * time.Second
+
+// handleModeration обрабатывает команды модератора mute / unmute / kick / ban.
+// права проверяются по БД на каждую команду, чтобы снятие роли действовало сразу.
+// возвращает ошибку с кодом для клиента (см. User.reply).
+//   - mute / unmute — сервер перестаёт / снова начинает пересылать RTP всех сессий пользователя цели
+//     (см. OnTrack); состояние хранится в комнате и переживает перезаход (см. Room.setMuted)
+//   - kick — цель получает kicked и отключается (User.Close)
+//   - ban — бан сохраняется в БД (HandleWebSocket больше не пустит); цель может быть не в комнате,
+//     тогда to — id пользователя. сессии забаненного в комнате отключаются, как при kick
+func (u *User) handleModeration(msg SignalMessage) error {
+	room := u.room.Load()
+	if room == nil {
+		return nil
+	}
+	if msg.To == "" {
+		return &ProtocolError{Code: CodeInvalidMessage, Message: msg.Type + " requires \"to\""}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), moderationTimeout)
+	defer cancel()
+
+	ok, err := store.IsRoomModerator(ctx, room.ID, u.account)
+	if err != nil {
+		log.Println("moderator lookup:", err)
+		return &ProtocolError{Code: CodeInternal, Message: "moderator lookup failed"}
+	}
+	if !ok {
+		return &ProtocolError{Code: CodeForbidden, Message: "moderator role required"}
+	}
+
+	// account — пользователь цели: у участника комнаты берётся из сессии, для бана отсутствующего — сам to
+	target := room.GetUser(msg.To)
+	var account string
+	switch {
+	case target != nil:
+		account = target.account
+	case msg.Type == TypeBan:
+		prof, err := store.GetUserByID(ctx, msg.To)
+		if err != nil {
+			log.Println("user lookup:", err)
+			return &ProtocolError{Code: CodeInternal, Message: "user lookup failed"}
+		}
+		if prof == nil {
+			return &ProtocolError{Code: CodeUserNotInRoom, Message: "user not found"}
+		}
+		account = prof.ID
+	default:
+		return &ProtocolError{Code: CodeUserNotInRoom, Message: "user is not in the room"}
+	}
+	// себя (в том числе свои WHIP-сессии) и владельца комнаты модерировать нельзя
+	if account == u.account {
+		return &ProtocolError{Code: CodeForbidden, Message: "cannot moderate yourself"}
+	}
+	if r, err := store.GetRoom(ctx, room.ID); err == nil && r != nil && r.OwnerID == account {
+		return &ProtocolError{Code: CodeForbidden, Message: "cannot moderate the room owner"}
+	}
+
+	log.Printf("moderation: %s %s -> %s in room %s\n", u.ID, msg.Type, msg.To, room.ID)
+	switch msg.Type {
+	case TypeMute, TypeUnmute:
+		sessions := room.setMuted(account, msg.Type == TypeMute)
+		// сообщаем всем, чтобы UI показал состояние, в том числе самому заглушённому
+		room.IterateUsers(func(other *User) {
+			for _, s := range sessions {
+				_ = other.Send(SignalMessage{Type: msg.Type, From: u.ID, To: s.ID})
+			}
+		})
+	case TypeBan:
+		if err := store.BanUser(ctx, room.ID, account, u.account); err != nil {
+			log.Println("ban user:", err)
+			return &ProtocolError{Code: CodeInternal, Message: "ban failed"}
+		}
+		room.IterateUsers(func(other *User) {
+			if other.account == account {
+				other.kick(u.ID, msg.Type)
+			}
+		})
+	case TypeKick:
+		target.kick(u.ID, msg.Type)
+	}
+	return nil
+}
+
+// kick сообщает участнику, что модератор by его исключил (reason — kick или ban), и отключает его
+func (u *User) kick(by, reason string) {
+	// kicked дойдёт до клиента: WritePump дописывает очередь перед закрытием сокета
+	_ = u.Send(SignalMessage{Type: TypeKicked, From: by, Code: reason})
+	u.Close()
+}
@@ -0,0 +1,303 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// negotiationState — состояние SDP-переговоров пользователя с точки зрения сервера.
+//
+// Используется паттерн WebRTC "perfect negotiation". Сервер — невежливая (impolite) сторона:
+// при glare (offer клиента пришёл, пока наш offer ещё без answer) offer клиента игнорируется,
+// а вежливый клиент откатывает свой offer и отвечает на наш.
+// Роли выбраны так по двум причинам:
+//   - offer сервера — это fan-out всей комнаты (треки источников, слоты, сведение, ICE restart),
+//     и он не должен теряться из-за offer одного клиента; браузер же откатывает offer штатно;
+//   - rollback в pion v4.1.5 неполный: SDPTypeRollback есть в setDescription, но проверка
+//     переходов (checkNextSignalingState) не пропускает have-local-offer → SetLocal(rollback) → stable,
+//     и SetLocalDescription возвращает InvalidModificationError. поэтому и answer, который
+//     не удалось применить, не откатить — такой участник закрывается (см. handleAnswer).
+type negotiationState int
+
+const (
+	// negotiationStable — нет незавершённых переговоров, можно отправлять offer
+	negotiationStable negotiationState = iota
+	// negotiationHaveLocalOffer — сервер отправил offer и ждёт answer клиента
+	negotiationHaveLocalOffer
+	// negotiationSendingAnswer — answer на offer клиента применён, но ещё не отправлен
+	// (ждёт ICE gathering без trickle); offer сервера в это время обогнал бы answer
+	negotiationSendingAnswer
+)
+
+func (s negotiationState) String() string {
+	switch s {
+	case negotiationStable:
+		return "stable"
+	case negotiationHaveLocalOffer:
+		return "have-local-offer"
+	case negotiationSendingAnswer:
+		return "sending-answer"
+	default:
+		return "unknown"
+	}
+}
+
+// Negotiate запускает SDP-переговоры с клиентом.
+// вызывается, когда на серверной PeerConnection меняется набор треков (добавили, удалили итд).
+// если предыдущий offer ещё не отвечен, новый не создаётся — выставляется pendingRenegotiation,
+// и после answer все накопленные изменения уйдут одним offer.
+func (u *User) Negotiate() {
+	// WHIP/WHEP renegotiation не поддерживают: набор треков фиксируется при создании сессии
+	pc := u.pc.Load()
+	if pc == nil || u.kind != sessionWS {
+		return
+	}
+	gathered, ok := u.createOffer(pc)
+	if !ok {
+		return
+	}
+
+	// без trickle ICE ожидаем завершения ICE gathering, чтобы LocalDescription содержал
+	// собранные ICE-кандидаты. ждём без negotiationMtx: состояние have-local-offer
+	// и так не пускает новые offer, а answerOffer и handleAnswer не блокируются
+	awaitGathering(gathered)
+	local := pc.LocalDescription()
+
+	// отправляем offer клиенту через signaling (WebSocket)
+	msg := SignalMessage{
+		Type:    TypeOffer,
+		SDP:     local.SDP,
+		SDPType: local.Type.String(),
+	}
+	if err := u.Send(msg); err != nil {
+		log.Println("send offer:", err)
+	}
+}
+
+// createOffer создаёт и применяет offer сервера, переводя переговоры в have-local-offer.
+// возвращает false, если offer сейчас не нужен (переговоры уже идут) или не удался.
+// gathered — окончание ICE gathering для режима без trickle, nil в режиме trickle
+func (u *User) createOffer(pc *webrtc.PeerConnection) (gathered <-chan struct{}, ok bool) {
+	u.negotiationMtx.Lock()
+	defer u.negotiationMtx.Unlock()
+
+	if u.negState != negotiationStable {
+		// переговоры уже идут — откладываем, offer отправится после answer
+		u.pendingRenegotiation = true
+		return nil, false
+	}
+	u.pendingRenegotiation = false
+	restart := u.pendingICERestart
+	u.pendingICERestart = false
+
+	// создаём SDP offer — описание текущего состояния PeerConnection:
+	// какие треки, кодеки и направления передачи сервер предлагает клиенту.
+	// при ICE restart offer несёт новые ice-ufrag/ice-pwd
+	offer, err := pc.CreateOffer(&webrtc.OfferOptions{ICERestart: restart})
+	if err != nil {
+		log.Println("CreateOffer:", err)
+		negotiationFailuresTotal.WithLabelValues("offer").Inc()
+		return nil, false
+	}
+
+	// promise берём до SetLocalDescription, чтобы не пропустить окончание gathering
+	if !trickleICE {
+		gathered = webrtc.GatheringCompletePromise(pc)
+	}
+	// устанавливаем offer как LocalDescription.
+	// этим мы фиксируем состояние PeerConnection и запускаем ICE-gathering
+	if err := pc.SetLocalDescription(offer); err != nil {
+		log.Println("SetLocalDescription:", err)
+		negotiationFailuresTotal.WithLabelValues("offer").Inc()
+		return nil, false
+	}
+	u.negState = negotiationHaveLocalOffer
+	return gathered, true
+}
+
+// awaitGathering ждёт окончания ICE gathering, но не дольше gatheringTimeout:
+// если STUN/TURN не отвечает, описание уходит с уже собранными кандидатами.
+// gathered == nil (режим trickle) — не ждёт
+func awaitGathering(gathered <-chan struct{}) {
+	if gathered == nil {
+		return
+	}
+	timer := time.NewTimer(gatheringTimeout)
+	defer timer.Stop()
+	select {
+	case <-gathered:
+	case <-timer.C:
+		log.Printf("ICE gathering not complete after %s, sending gathered candidates\n", gatheringTimeout)
+	}
+}
+
+// errGlare — offer клиента отклонён из-за glare: клиент должен ответить на offer сервера
+var errGlare = &ProtocolError{Code: CodeGlare, Message: "server offer pending, answer it first"}
+
+// answerOffer применяет offer клиента и отсылает answer.
+// при glare (у сервера есть неотвеченный offer) offer клиента игнорируется — сервер impolite —
+// и возвращается errGlare, чтобы клиент получил отказ, а не ack.
+func (u *User) answerOffer(offerSDP string) error {
+	pc := u.pc.Load()
+	gathered, err := u.applyOffer(pc, offerSDP)
+	if err != nil {
+		return err
+	}
+
+	// без trickle ICE ждём, пока ICE-агент соберёт все локальные кандидаты для PeerConnection;
+	// в режиме trickle answer уходит сразу, а кандидаты досылаются через OnICECandidate.
+	// ждём без negotiationMtx: состояние sending-answer откладывает offer сервера до отправки answer
+	awaitGathering(gathered)
+
+	/// берем локальное описание (answer + локальные ICE кандидаты) для отправки клиенту через WebSocket
+	local := pc.LocalDescription()
+	resp := SignalMessage{
+		Type:    TypeAnswer,
+		SDP:     local.SDP,
+		SDPType: local.Type.String(),
+	}
+	// отправляем клиенту answer через WebSocket
+	// после этого клиент сможет установить remote description и начать передачу аудио
+	err = u.Send(resp)
+
+	u.negotiationMtx.Lock()
+	u.negState = negotiationStable
+	// пока отвечали клиенту, набор треков мог измениться — догоняем одним offer
+	renegotiate := u.pendingRenegotiation || u.pendingICERestart
+	u.negotiationMtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if renegotiate {
+		go u.Negotiate()
+	}
+	return nil
+}
+
+// applyOffer применяет offer клиента и answer сервера, переводя переговоры в sending-answer.
+// gathered — окончание ICE gathering для режима без trickle, nil в режиме trickle
+func (u *User) applyOffer(pc *webrtc.PeerConnection, offerSDP string) (gathered <-chan struct{}, err error) {
+	u.negotiationMtx.Lock()
+	defer u.negotiationMtx.Unlock()
+
+	if u.negState != negotiationStable {
+		log.Printf("glare: ignoring client offer from %s, server offer pending (%s)\n", u.ID, u.negState)
+		return nil, errGlare
+	}
+
+	// преобразуем offer клиента в SessionDescription и ставим как remote description
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerSDP, // SDP клиента с его кодеками, треками и ICE
+	}
+
+	// устанавливаем remote description на серверной PeerConnection чтобы, PC знал треки, кодеки и ICE-кандидаты
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return nil, err
+	}
+	// теперь у PC есть remote description — добавляем кандидатов, пришедших раньше offer
+	u.flushPendingCandidates()
+
+	// создаём ответ сервера (answer) и ставим как локальное описание
+	// теперь сервер знает, какие треки/кодеки/ICE он предлагает клиенту
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !trickleICE {
+		gathered = webrtc.GatheringCompletePromise(pc)
+	}
+	// устанавливаем локальное описание на сервере — answer
+	// теперь сервер знает, какие треки/кодеки/ICE он предлагает клиенту
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+	u.negState = negotiationSendingAnswer
+	return gathered, nil
+}
+
+// handleAnswer применяет answer клиента на offer сервера и возвращает переговоры в stable.
+// если за время ожидания накопились изменения треков — запускает следующий offer.
+// если answer не применился, PeerConnection остаётся в have-local-offer, а откатить
+// локальный offer pion не умеет (см. negotiationState) — переговоры с этим PeerConnection
+// больше невозможны: возвращается negotiation_failed, и ReadPump закрывает участника —
+// клиент заходит заново с новым PeerConnection
+func (u *User) handleAnswer(answerSDP string) error {
+	// если PeerConnection ещё не создан — ничего не делаем, логируем
+	pc := u.pc.Load()
+	if pc == nil {
+		log.Println("received answer but PC is nil")
+		return &ProtocolError{Code: CodeInvalidMessage, Message: "no offer to answer"}
+	}
+
+	u.negotiationMtx.Lock()
+	defer u.negotiationMtx.Unlock()
+
+	if u.negState != negotiationHaveLocalOffer {
+		log.Printf("unexpected answer from %s in state %s, ignoring\n", u.ID, u.negState)
+		return &ProtocolError{Code: CodeInvalidMessage, Message: "no offer to answer"}
+	}
+
+	// создаём объект SessionDescription с типом Answer
+	// это SDP, которое клиент сформировал в ответ на наш offer
+	sdp := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answerSDP,
+	}
+
+	// устанавливаем это описание как remote description в PeerConnection
+	// после этого WebRTC знает, какие кодеки, форматы, ICE кандидаты использует клиент
+	// теперь наш PeerConnection может начать отправлять и получать RTP/RTCP потоки
+	if err := pc.SetRemoteDescription(sdp); err != nil {
+		log.Println("SetRemoteDescription answer:", err)
+		negotiationFailuresTotal.WithLabelValues("remote_answer").Inc()
+		return &ProtocolError{Code: CodeNegotiationFailed, Message: "answer rejected, join again"}
+	}
+	u.negState = negotiationStable
+
+	// изменения треков, пришедшие во время ожидания answer, отправляем одним offer
+	if u.pendingRenegotiation || u.pendingICERestart {
+		go u.Negotiate()
+	}
+	return nil
+}
+
+// restartICE перезапускает ICE новым offer сервера (после resume, если ICE за время обрыва деградировал).
+// если предыдущий offer ещё без answer, он отправляется клиенту повторно, а restart пойдёт следующим offer
+func (u *User) restartICE() {
+	u.negotiationMtx.Lock()
+	u.pendingICERestart = true
+	u.negotiationMtx.Unlock()
+	u.resendPendingOffer()
+	u.Negotiate()
+}
+
+// resendPendingOffer повторно отправляет неотвеченный offer сервера:
+// он мог уйти в оборванный WebSocket и не дойти до клиента
+func (u *User) resendPendingOffer() {
+	u.negotiationMtx.Lock()
+	defer u.negotiationMtx.Unlock()
+	if u.negState != negotiationHaveLocalOffer {
+		return
+	}
+	local := u.pc.Load().LocalDescription()
+	if local == nil {
+		return
+	}
+	if err := u.Send(SignalMessage{Type: TypeOffer, SDP: local.SDP, SDPType: local.Type.String()}); err != nil {
+		log.Println("resend offer:", err)
+	}
+}
+
+// offerError переводит ошибку ответа на offer клиента в ошибку протокола:
+// glare отдаётся как есть, остальное — offer_failed
+func offerError(err error) error {
+	if errors.Is(err, errGlare) {
+		return err
+	}
+	return &ProtocolError{Code: CodeOfferFailed, Message: "offer rejected"}
+}
@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// nextSignal ждёт в очереди отправки u сообщение типа typ, пропуская остальные (кандидаты и т.п.)
+func nextSignal(t *testing.T, u *User, typ string) SignalMessage {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-u.send:
+			if msg.Type == typ {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %s sent", typ)
+		}
+	}
+}
+
+// connectedUser поднимает серверного пользователя и клиентский PeerConnection и проводит первый обмен offer/answer
+func connectedUser(t *testing.T) (*User, *webrtc.PeerConnection) {
+	t.Helper()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := NewUser(nil, nil)
+	t.Cleanup(func() {
+		u.Close()
+		_ = client.Close()
+	})
+	if _, err := client.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ReceiveOfferAndAnswerBack(offer.SDP); err != nil {
+		t.Fatal(err)
+	}
+	answer := nextSignal(t, u, TypeAnswer)
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+	if u.negState != negotiationStable {
+		t.Fatalf("after answer: state %s, want stable", u.negState)
+	}
+	return u, client
+}
+
+// perfect negotiation: сервер impolite — при glare отклоняет offer клиента,
+// а изменения, пришедшие во время ожидания answer, уходят одним следующим offer
+func TestNegotiationGlare(t *testing.T) {
+	u, client := connectedUser(t)
+
+	u.Negotiate()
+	offer := nextSignal(t, u, TypeOffer)
+	if u.negState != negotiationHaveLocalOffer {
+		t.Fatalf("after offer: state %s, want have-local-offer", u.negState)
+	}
+
+	// клиент одновременно шлёт свой offer — glare
+	glare, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ReceiveOfferAndAnswerBack(glare.SDP); !errors.Is(err, errGlare) {
+		t.Fatalf("client offer during glare: %v, want errGlare", err)
+	}
+
+	// пока offer без answer, новый не создаётся
+	u.Negotiate()
+	if !u.pendingRenegotiation {
+		t.Error("renegotiation not postponed while offer pending")
+	}
+	for _, msg := range sent(u) {
+		if msg.Type == TypeOffer {
+			t.Fatal("second offer sent before answer")
+		}
+	}
+
+	// вежливый клиент отвечает на offer сервера — отложенная renegotiation уходит следующим offer
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := client.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.handleAnswer(answer.SDP); err != nil {
+		t.Fatal(err)
+	}
+	nextSignal(t, u, TypeOffer)
+}
+
+func TestUnexpectedAnswer(t *testing.T) {
+	u, _ := connectedUser(t)
+	var pe *ProtocolError
+	if err := u.handleAnswer("v=0"); !errors.As(err, &pe) || pe.Code != CodeInvalidMessage {
+		t.Errorf("answer in stable state: %v, want %s", err, CodeInvalidMessage)
+	}
+	if u.negState != negotiationStable {
+		t.Errorf("state %s after unexpected answer, want stable", u.negState)
+	}
+}
+
+func TestRejectedAnswer(t *testing.T) {
+	u, _ := connectedUser(t)
+	u.Negotiate()
+	nextSignal(t, u, TypeOffer)
+	var pe *ProtocolError
+	if err := u.handleAnswer("not sdp"); !errors.As(err, &pe) || pe.Code != CodeNegotiationFailed {
+		t.Errorf("broken answer: %v, want %s", err, CodeNegotiationFailed)
+	}
+}
+
+// без trickle ICE ожидание gathering ограничено gatheringTimeout
+func TestAwaitGatheringTimeout(t *testing.T) {
+	defer func(d time.Duration) { gatheringTimeout = d }(gatheringTimeout)
+	gatheringTimeout = 10 * time.Millisecond
+
+	start := time.Now()
+	awaitGathering(make(chan struct{}))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("awaitGathering blocked %s", elapsed)
+	}
+	awaitGathering(nil)
+}
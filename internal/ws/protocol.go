@@ -0,0 +1,107 @@
+package ws
+
+import (
+	"errors"
+	"log"
+)
+
+// сигнальный протокол WebSocket, версия ProtocolVersion.
+// все сообщения — SignalMessage (JSON), тип задаётся полем type (Type* ниже).
+//
+// версия: клиент передаёт "v" в join/resume, сервер — в roster/resumed. join без "v" считается
+// версией 1; версия новее ProtocolVersion отклоняется с unsupported_version.
+//
+// запросы и ответы: клиент может проставить в любом своём сообщении "id" (произвольная строка).
+// на такое сообщение сервер отвечает ровно один раз — {"type":"ack","id"} после успешной обработки
+// или {"type":"error","id","code","error"} при отказе. join подтверждается после roster
+// (и answer, если в join был offer). сообщения без id подтверждений не получают, ошибки по ним
+// приходят без id. ошибки до входа в комнату (всё, что отклоняет первое сообщение) закрывают сокет.
+//
+// коды ошибок стабильны и не меняются между версиями: на них завязывается клиент,
+// текст в "error" — только для человека. коды объявлены рядом с проверками:
+// здесь — общие ошибки протокола, в access.go — отказы во входе, в moderation.go и recorder.go —
+// ошибки команд, в resume.go — session_expired.
+
+// ProtocolVersion — версия сигнального протокола сервера
+const ProtocolVersion = 1
+
+// типы сообщений клиент → сервер
+const (
+	TypeJoin           = "join"      // вход в комнату: room, token, password?, mode?, sdp? (первое сообщение)
+	TypeResume         = "resume"    // возобновление сессии: session, token, iceRestart? (первое сообщение, см. resume.go)
+	TypeOffer          = "offer"     // offer клиента (renegotiation); в обратную сторону — offer сервера
+	TypeAnswer         = "answer"    // answer клиента на offer сервера; в обратную сторону — answer сервера
+	TypeCandidate      = "candidate" // ICE-кандидат клиента
+	TypeLeave          = "leave"     // выход из комнаты
+	TypeMute           = "mute"      // команды модератора, цель — to (см. moderation.go); mute/unmute
+	TypeUnmute         = "unmute"    // сервер рассылает и всей комнате
+	TypeKick           = "kick"
+	TypeBan            = "ban"
+	TypeStartRecording = "startRecording" // запись комнаты (см. recorder.go)
+	TypeStopRecording  = "stopRecording"
+)
+
+// типы сообщений сервер → клиент
+const (
+	TypeAck                 = "ack"                 // запрос id обработан
+	TypeError               = "error"               // ошибка: code, error, id запроса (если был)
+	TypeRoster              = "roster"              // вход выполнен: to, displayName, session, peers, v
+	TypeResumed             = "resumed"             // сессия возобновлена: то же, что roster
+	TypePeerJoined          = "peerJoined"          // from вошёл в комнату
+	TypePeerLeft            = "peerLeft"            // from вышел
+	TypeCandidateFromServer = "candidateFromServer" // ICE-кандидат сервера (trickle ICE)
+	TypeEndOfCandidates     = "endOfCandidates"     // кандидатов сервера больше не будет
+	TypeSpeaking            = "speaking"            // from начал/закончил говорить (см. vad.go)
+	TypeActiveSpeaker       = "activeSpeaker"       // from — самый громкий говорящий
+	TypeSlot                = "slot"                // источник from за слотом пересылки (см. lastn.go)
+	TypeStats               = "stats"               // статистика соединений комнаты (см. stats.go)
+	TypeRecordingStarted    = "recordingStarted"    // запись комнаты включил from
+	TypeRecordingStopped    = "recordingStopped"    // запись выключена
+	TypeKicked              = "kicked"              // модератор from исключил получателя, code — kick или ban
+)
+
+// общие коды ошибок протокола
+const (
+	CodeBadRequest         = "bad_request"         // сообщение — не JSON или не SignalMessage
+	CodeJoinRequired       = "join_required"       // первое сообщение не join/resume или в join нет room
+	CodeUnsupportedVersion = "unsupported_version" // клиент говорит на версии новее ProtocolVersion
+	CodeUnauthorized       = "unauthorized"        // нет токена, токен неверный или пользователя нет в БД
+	CodeAlreadyJoined      = "already_joined"      // пользователь уже в этой комнате (с другого устройства или WHIP)
+	CodeOfferFailed        = "offer_failed"        // offer клиента не удалось применить
+	CodeGlare              = "glare"               // offer клиента отклонён: у сервера свой offer без answer (см. negotiation.go)
+	CodeNegotiationFailed  = "negotiation_failed"  // answer клиента не применился, участник отключён — нужно войти заново
+	CodeUnknownType        = "unknown_type"        // неизвестный тип сообщения
+	CodeMixUnavailable     = "mix_unavailable"     // join в режиме mixed, а сервер собран без Opus (см. mcu.go)
+)
+
+// ProtocolError — отказ в обработке сообщения клиента (в том числе во входе в комнату) с кодом для него
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string { return e.Code + ": " + e.Message }
+
+// errorCode переводит ошибку обработки сообщения в код и текст для клиента;
+// ошибки без кода (БД и т.п.) клиенту не раскрываются
+func errorCode(err error) (code, text string) {
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		return pe.Code, pe.Message
+	}
+	log.Println("signal message:", err)
+	return CodeInternal, "internal error"
+}
+
+// reply отвечает на сообщение клиента msg: ack при err == nil (только если у msg есть id)
+// или error с кодом из err
+func (u *User) reply(msg SignalMessage, err error) {
+	if err == nil {
+		if msg.ID != "" {
+			_ = u.Send(SignalMessage{Type: TypeAck, ID: msg.ID})
+		}
+		return
+	}
+	code, text := errorCode(err)
+	_ = u.Send(SignalMessage{Type: TypeError, ID: msg.ID, Code: code, Error: text})
+}
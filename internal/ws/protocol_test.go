@@ -0,0 +1,196 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSignalMessageOmitsEmptyFields(t *testing.T) {
+	raw, err := json.Marshal(SignalMessage{Type: TypeAck, ID: "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"ack","id":"7"}`; string(raw) != want {
+		t.Errorf("ack = %s, want %s", raw, want)
+	}
+}
+
+// коды — часть протокола: клиент сравнивает их как строки, поэтому они не должны совпадать
+func TestErrorCodesUnique(t *testing.T) {
+	codes := []string{
+		CodeBadRequest, CodeJoinRequired, CodeUnsupportedVersion, CodeUnauthorized,
+		CodeAlreadyJoined, CodeOfferFailed, CodeGlare, CodeNegotiationFailed, CodeUnknownType,
+		CodeRoomForbidden, CodeRoomPasswordRequired, CodeRoomWrongPassword, CodeRoomBanned, CodeInternal,
+		CodeForbidden, CodeUserNotInRoom, CodeInvalidMessage,
+		CodeRecordingActive, CodeRecordingInactive, CodeMessageInvalid, CodeSessionExpired, CodeMixUnavailable,
+	}
+	seen := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		if c == "" {
+			t.Error("empty error code")
+		}
+		if seen[c] {
+			t.Errorf("duplicate error code %q", c)
+		}
+		seen[c] = true
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code string
+		text string
+	}{
+		{"protocol", &ProtocolError{Code: CodeForbidden, Message: "not a moderator"}, CodeForbidden, "not a moderator"},
+		{"wrapped protocol", fmt.Errorf("kick: %w", &ProtocolError{Code: CodeUserNotInRoom, Message: "gone"}), CodeUserNotInRoom, "gone"},
+		{"internal", errors.New("pq: connection refused"), CodeInternal, "internal error"},
+	}
+	for _, tt := range tests {
+		code, text := errorCode(tt.err)
+		if code != tt.code || text != tt.text {
+			t.Errorf("%s: errorCode = %q, %q; want %q, %q", tt.name, code, text, tt.code, tt.text)
+		}
+	}
+}
+
+// sent возвращает сообщения, накопившиеся в очереди отправки u
+func sent(u *User) []SignalMessage {
+	var msgs []SignalMessage
+	for {
+		select {
+		case msg := <-u.send:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	u := NewUser(nil, nil)
+
+	u.reply(SignalMessage{Type: TypeMute}, nil)
+	if msgs := sent(u); len(msgs) != 0 {
+		t.Errorf("success without id: sent %+v, want nothing", msgs)
+	}
+
+	u.reply(SignalMessage{Type: TypeMute, ID: "1"}, nil)
+	want := []SignalMessage{{Type: TypeAck, ID: "1"}}
+	if msgs := sent(u); !reflect.DeepEqual(msgs, want) {
+		t.Errorf("success with id: sent %+v, want %+v", msgs, want)
+	}
+
+	u.reply(SignalMessage{Type: TypeOffer, ID: "2"}, errGlare)
+	want = []SignalMessage{{Type: TypeError, ID: "2", Code: CodeGlare, Error: errGlare.Message}}
+	if msgs := sent(u); !reflect.DeepEqual(msgs, want) {
+		t.Errorf("error with id: sent %+v, want %+v", msgs, want)
+	}
+
+	// ошибка без id всё равно доходит до клиента, а внутренний текст — нет
+	u.reply(SignalMessage{Type: TypeKick}, errors.New("db down"))
+	want = []SignalMessage{{Type: TypeError, Code: CodeInternal, Error: "internal error"}}
+	if msgs := sent(u); !reflect.DeepEqual(msgs, want) {
+		t.Errorf("error without id: sent %+v, want %+v", msgs, want)
+	}
+}
+
+func TestOfferError(t *testing.T) {
+	if code, _ := errorCode(offerError(errGlare)); code != CodeGlare {
+		t.Errorf("glare: code %q, want %q", code, CodeGlare)
+	}
+	if code, text := errorCode(offerError(errors.New("sdp: invalid"))); code != CodeOfferFailed || text != "offer rejected" {
+		t.Errorf("other: %q, %q; want %q, %q", code, text, CodeOfferFailed, "offer rejected")
+	}
+}
+
+// wsPair соединяет тестового WebSocket-клиента с сервером и возвращает серверный и клиентский conn
+func wsPair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error("upgrade:", err)
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return <-conns, client
+}
+
+// readSignal читает следующее сообщение сервера на стороне клиента
+func readSignal(t *testing.T, client *websocket.Conn) SignalMessage {
+	t.Helper()
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg SignalMessage
+	if err := client.ReadJSON(&msg); err != nil {
+		t.Fatal("read signal:", err)
+	}
+	return msg
+}
+
+// TestReadPumpReplies проверяет ответы ReadPump на ошибочные и корректные сообщения клиента:
+// код и текст приходят от настоящих обработчиков, id запроса возвращается в ответе
+func TestReadPumpReplies(t *testing.T) {
+	conn, client := wsPair(t)
+	u := NewUser(conn, nil)
+	if err := joinRoom(u, "replies-room", 0); err != nil {
+		t.Fatal(err)
+	}
+	go u.WritePump(conn, u.connDone)
+	go u.ReadPump(conn)
+	if msg := readSignal(t, client); msg.Type != TypeRoster {
+		t.Fatalf("first message %+v, want roster", msg)
+	}
+
+	tests := []struct {
+		req  string
+		want SignalMessage
+	}{
+		{`{`, SignalMessage{Type: TypeError, Code: CodeBadRequest, Error: "invalid JSON"}},
+		{`{"type":"dance","id":"1"}`, SignalMessage{Type: TypeError, ID: "1", Code: CodeUnknownType, Error: "unknown message type dance"}},
+		{`{"type":"offer","id":"2"}`, SignalMessage{Type: TypeError, ID: "2", Code: CodeInvalidMessage, Error: "offer requires sdp"}},
+		{`{"type":"answer","id":"3","sdp":"v=0","sdpType":"answer"}`, SignalMessage{Type: TypeError, ID: "3", Code: CodeInvalidMessage, Error: "no offer to answer"}},
+		{`{"type":"candidate","id":"4","candidate":"nope"}`, SignalMessage{Type: TypeError, ID: "4", Code: CodeInvalidMessage, Error: "invalid candidate"}},
+		{`{"type":"mute","id":"5"}`, SignalMessage{Type: TypeError, ID: "5", Code: CodeInvalidMessage, Error: "mute requires \"to\""}},
+		// PeerConnection ещё нет — кандидат откладывается до offer, но запрос подтверждается
+		{`{"type":"candidate","id":"6","candidate":{"candidate":"candidate:1 1 udp 1 10.0.0.1 5000 typ host"}}`, SignalMessage{Type: TypeAck, ID: "6"}},
+		{`{"type":"leave","id":"7"}`, SignalMessage{Type: TypeAck, ID: "7"}},
+	}
+	for _, tt := range tests {
+		if err := client.WriteMessage(websocket.TextMessage, []byte(tt.req)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readSignal(t, client); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.req, got, tt.want)
+		}
+	}
+
+	// после leave сервер закрывает сокет, а участник уходит из комнаты
+	if _, _, err := client.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("after leave: %v, want normal close", err)
+	}
+	if LookupRoom("replies-room") != nil {
+		t.Error("room still active after its only user left")
+	}
+	if len(u.pendingCandidates) != 1 {
+		t.Errorf("pending candidates = %d, want 1", len(u.pendingCandidates))
+	}
+}
@@ -0,0 +1,359 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"voicechat/internal/mixer"
+	"voicechat/internal/store"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// коды ошибок команд записи
+const (
+	CodeRecordingActive   = "recording_active"   // запись уже идёт
+	CodeRecordingInactive = "recording_inactive" // запись не идёт
+)
+
+var (
+	errRecordingActive   = errors.New("recording already active")
+	errRecordingInactive = errors.New("recording not active")
+)
+
+// roomRecorder — запись комнаты: по Ogg/Opus файлу на каждого говорящего участника
+// и (если включено) сведение всей комнаты в один файл.
+// пакеты снимаются в цикле пересылки OnTrack (после проверки mute), файлы открываются
+// при старте записи для уже говорящих и в OnTrack для новых источников.
+type roomRecorder struct {
+	roomID    string
+	startedBy string
+
+	mtx    sync.Mutex
+	tracks map[string]*trackRecorder // ключ — id источника
+
+	// mix — сведение комнаты, nil если выключено (VOICECHAT_RECORDING_MIX=false)
+	mix *mixRecorder
+}
+
+// mixRecorder — файл сведения комнаты. кадры раз в 20 мс пишет тикер сведения комнаты
+// (runMix, см. mcu.go) — тот же микшер, что у получателей в режиме mixed
+type mixRecorder struct {
+	id   string // id записи в store
+	mtx  sync.Mutex
+	sink mixer.Sink // nil — файл закрыт (запись остановлена или сломалась)
+}
+
+// trackRecorder — файл записи одного участника
+type trackRecorder struct {
+	id     string // id записи в store
+	mtx    sync.Mutex
+	w      *oggwriter.OggWriter // nil, пока файл создаётся (см. roomRecorder.open)
+	closed bool                 // файл закрыт или закроется, как только будет создан
+}
+
+// recordable сообщает, можно ли записать трек с таким кодеком (oggwriter пишет только Opus)
+func recordable(codec webrtc.RTPCodecParameters) bool {
+	return strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus)
+}
+
+// StartRecording включает запись комнаты: открывает файлы для уже говорящих участников
+// и сообщает всем recordingStarted
+func (r *Room) StartRecording(by string) error {
+	if err := os.MkdirAll(recordingsDir, 0o755); err != nil {
+		return err
+	}
+
+	if r.Recording() {
+		return errRecordingActive
+	}
+	// файл сведения и его строку в БД создаём без r.mtx: комната в это время продолжает работать
+	var mix *mixRecorder
+	if recordingMix {
+		mix = newMixRecorder(r.ID)
+	}
+
+	r.mtx.Lock()
+	if r.recorder != nil {
+		// запись параллельно включил кто-то другой
+		r.mtx.Unlock()
+		if mix != nil {
+			mix.close()
+		}
+		return errRecordingActive
+	}
+	rec := &roomRecorder{roomID: r.ID, startedBy: by, tracks: make(map[string]*trackRecorder), mix: mix}
+	r.recorder = rec
+	if mix != nil {
+		r.startMixLocked().rec = mix
+	}
+	// источник → пользователь, от имени которого пишется файл
+	srcs := make(map[string]string, len(r.tracks))
+	for id, t := range r.tracks {
+		if u := r.users[id]; u != nil && recordable(t.Codec()) {
+			srcs[id] = u.account
+		}
+	}
+	r.mtx.Unlock()
+
+	for srcID, account := range srcs {
+		rec.open(srcID, account)
+	}
+	log.Printf("recording started in room %s by %s\n", r.ID, by)
+	r.IterateUsers(func(u *User) {
+		_ = u.Send(SignalMessage{Type: TypeRecordingStarted, Room: r.ID, From: by})
+	})
+	return nil
+}
+
+// StopRecording останавливает запись комнаты и закрывает файлы.
+// by — кто остановил ("" — запись остановлена сервером, например комната опустела)
+func (r *Room) StopRecording(by string) error {
+	r.mtx.Lock()
+	rec := r.recorder
+	r.recorder = nil
+	if rec != nil && rec.mix != nil && r.mix != nil && r.mix.rec == rec.mix {
+		r.mix.rec = nil
+		r.stopMixLocked()
+	}
+	r.mtx.Unlock()
+	if rec == nil {
+		return errRecordingInactive
+	}
+
+	rec.closeAll()
+	log.Printf("recording stopped in room %s\n", r.ID)
+	r.IterateUsers(func(u *User) {
+		_ = u.Send(SignalMessage{Type: TypeRecordingStopped, Room: r.ID, From: by})
+	})
+	return nil
+}
+
+// Recording сообщает, идёт ли в комнате запись
+func (r *Room) Recording() bool {
+	return r.activeRecorder() != nil
+}
+
+// activeRecorder возвращает текущую запись комнаты или nil
+func (r *Room) activeRecorder() *roomRecorder {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.recorder
+}
+
+// open начинает файл записи источника srcID пользователя account, если его ещё нет.
+// место источника занимается сразу, а файл и строка в БД создаются без rec.mtx,
+// чтобы запись других источников не ждала БД; до готовности файла write пакеты не пишет
+func (rec *roomRecorder) open(srcID, account string) {
+	rec.mtx.Lock()
+	if _, ok := rec.tracks[srcID]; ok {
+		rec.mtx.Unlock()
+		return
+	}
+	tr := &trackRecorder{id: uuid.New().String()}
+	rec.tracks[srcID] = tr
+	rec.mtx.Unlock()
+
+	path := filepath.Join(recordingsDir, tr.id+".ogg")
+	w, err := oggwriter.New(path, 48000, 2)
+	if err != nil {
+		log.Println("create recording file:", err)
+		rec.drop(srcID, tr)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), moderationTimeout)
+	defer cancel()
+	if _, err := store.CreateRecording(ctx, tr.id, rec.roomID, account, store.RecordingTrack, path); err != nil {
+		log.Println("save recording:", err)
+		_ = w.Close()
+		_ = os.Remove(path)
+		rec.drop(srcID, tr)
+		return
+	}
+
+	tr.mtx.Lock()
+	tr.w = w
+	closed := tr.closed
+	tr.mtx.Unlock()
+	if closed {
+		// источник ушёл или запись остановили, пока файл создавался
+		tr.close()
+		return
+	}
+	log.Printf("recording %s: user %s in room %s -> %s\n", tr.id, srcID, rec.roomID, path)
+}
+
+// drop освобождает место источника после неудачного open, чтобы его можно было открыть заново
+func (rec *roomRecorder) drop(srcID string, tr *trackRecorder) {
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	if rec.tracks[srcID] == tr {
+		delete(rec.tracks, srcID)
+	}
+}
+
+// write дописывает RTP-пакет источника в его файл (если источник записывается)
+func (rec *roomRecorder) write(srcID string, pkt *rtp.Packet) {
+	rec.mtx.Lock()
+	tr := rec.tracks[srcID]
+	rec.mtx.Unlock()
+	if tr == nil {
+		return
+	}
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	if tr.w == nil {
+		return
+	}
+	if err := tr.w.WriteRTP(pkt); err != nil {
+		log.Println("recording write:", err)
+	}
+}
+
+// closeSource закрывает файл источника (участник ушёл или его трек закончился)
+func (rec *roomRecorder) closeSource(srcID string) {
+	rec.mtx.Lock()
+	tr := rec.tracks[srcID]
+	delete(rec.tracks, srcID)
+	rec.mtx.Unlock()
+	if tr != nil {
+		tr.close()
+	}
+}
+
+// closeAll закрывает файлы всех источников
+func (rec *roomRecorder) closeAll() {
+	rec.mtx.Lock()
+	trs := rec.tracks
+	rec.tracks = make(map[string]*trackRecorder)
+	rec.mtx.Unlock()
+	for _, tr := range trs {
+		tr.close()
+	}
+	if rec.mix != nil {
+		rec.mix.close()
+	}
+}
+
+// newMixRecorder открывает файл сведения комнаты.
+// при ошибке запись идёт без сведения (nil)
+func newMixRecorder(roomID string) *mixRecorder {
+	id := uuid.New().String()
+	path := filepath.Join(recordingsDir, id+"."+recordingMixFormat)
+	sink, err := mixer.NewFileSink(path, recordingMixFormat)
+	if err != nil {
+		log.Println("create mix file:", err)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), moderationTimeout)
+	defer cancel()
+	if _, err := store.CreateRecording(ctx, id, roomID, "", store.RecordingMix, path); err != nil {
+		log.Println("save mix recording:", err)
+		_ = sink.Close()
+		_ = os.Remove(path)
+		return nil
+	}
+	log.Printf("recording %s: mix of room %s -> %s\n", id, roomID, path)
+	return &mixRecorder{id: id, sink: sink}
+}
+
+// write дописывает кадр сведения в файл.
+// тишина тоже пишется, чтобы файл совпадал по времени со встречей
+func (m *mixRecorder) write(pcm []float32) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.sink == nil {
+		return
+	}
+	if err := m.sink.WriteFrame(pcm); err != nil {
+		log.Println("mix write:", err)
+		m.closeSink()
+	}
+}
+
+// closeSink закрывает файл сведения. вызывается под m.mtx
+func (m *mixRecorder) closeSink() {
+	if m.sink == nil {
+		return
+	}
+	if err := m.sink.Close(); err != nil {
+		log.Println("close mix file:", err)
+	}
+	m.sink = nil
+}
+
+// close закрывает файл и отмечает окончание записи
+func (m *mixRecorder) close() {
+	m.mtx.Lock()
+	m.closeSink()
+	m.mtx.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), moderationTimeout)
+	defer cancel()
+	if err := store.FinishRecording(ctx, m.id); err != nil {
+		log.Println("finish mix recording:", err)
+	}
+}
+
+// close закрывает файл и отмечает окончание записи в store
+func (tr *trackRecorder) close() {
+	tr.mtx.Lock()
+	w := tr.w
+	tr.w = nil
+	tr.closed = true
+	tr.mtx.Unlock()
+	if w == nil {
+		return
+	}
+	if err := w.Close(); err != nil {
+		log.Println("close recording file:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), moderationTimeout)
+	defer cancel()
+	if err := store.FinishRecording(ctx, tr.id); err != nil {
+		log.Println("finish recording:", err)
+	}
+}
+
+// handleRecording обрабатывает команды startRecording / stopRecording (только модераторы)
+// возвращает ошибку с кодом для клиента (см. User.reply)
+func (u *User) handleRecording(msg SignalMessage) error {
+	room := u.room.Load()
+	if room == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), moderationTimeout)
+	defer cancel()
+	ok, err := store.IsRoomModerator(ctx, room.ID, u.account)
+	if err != nil {
+		log.Println("moderator lookup:", err)
+		return &ProtocolError{Code: CodeInternal, Message: "moderator lookup failed"}
+	}
+	if !ok {
+		return &ProtocolError{Code: CodeForbidden, Message: "moderator role required"}
+	}
+
+	if msg.Type == TypeStartRecording {
+		err = room.StartRecording(u.ID)
+	} else {
+		err = room.StopRecording(u.ID)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errRecordingActive):
+		return &ProtocolError{Code: CodeRecordingActive, Message: "recording already active"}
+	case errors.Is(err, errRecordingInactive):
+		return &ProtocolError{Code: CodeRecordingInactive, Message: "recording not active"}
+	default:
+		log.Println("recording command:", err)
+		return &ProtocolError{Code: CodeInternal, Message: "recording failed"}
+	}
+}
@@ -0,0 +1,200 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"sync"
+	"time"
+
+	"voicechat/internal/auth"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// возобновление сессии после обрыва WebSocket.
+// при входе клиент получает в roster токен сессии (session). если WebSocket рвётся
+// (не leave), пользователь не удаляется сразу: он остаётся в комнате вместе с
+// PeerConnection ещё resumeGrace — RTP продолжает ходить, если ICE жив.
+// за это время клиент открывает новый WebSocket и первым сообщением шлёт
+// {"type":"resume","session","token"}; сервер привязывает новое соединение к тому же User
+// и отвечает resumed со снимком участников, за которым идут текущие слоты last-N и активный спикер.
+// если ICE за время обрыва сломался — сервер перезапускает ICE (offer с новыми ice-ufrag/ice-pwd).
+// пока соединения нет, сигнальные сообщения отбрасываются: resumed заменяет пропущенное.
+
+// CodeSessionExpired — токена сессии нет или истёк grace period, нужно заново войти через join
+const CodeSessionExpired = "session_expired"
+
+var (
+	// resumable — сессии WebSocket-участников по токену возобновления
+	resumable    = make(map[string]*User)
+	resumableMtx sync.Mutex
+)
+
+// newSessionToken генерирует случайный токен возобновления
+func newSessionToken() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// rememberSession делает сессию пользователя возобновляемой по u.session
+func rememberSession(u *User) {
+	resumableMtx.Lock()
+	defer resumableMtx.Unlock()
+	resumable[u.session] = u
+}
+
+// forgetSession убирает закрытого пользователя из resumable
+func forgetSession(u *User) {
+	if u.session == "" {
+		return
+	}
+	resumableMtx.Lock()
+	defer resumableMtx.Unlock()
+	if resumable[u.session] == u {
+		delete(resumable, u.session)
+	}
+}
+
+// detach отвязывает оборвавшийся WebSocket conn от пользователя и запускает grace period.
+// повторные вызовы и вызовы для старого соединения ничего не делают
+func (u *User) detach(conn *websocket.Conn) {
+	select {
+	case <-u.done:
+		return
+	default:
+	}
+	u.connMtx.Lock()
+	if u.Conn != conn || u.detached {
+		u.connMtx.Unlock()
+		return
+	}
+	u.detached = true
+	close(u.connDone)
+	_ = conn.Close()
+	if resumeGrace <= 0 {
+		u.connMtx.Unlock()
+		u.Close()
+		return
+	}
+	gen := u.connGen
+	u.graceTimer = time.AfterFunc(resumeGrace, func() {
+		u.connMtx.Lock()
+		expired := u.detached && u.connGen == gen
+		u.connMtx.Unlock()
+		if expired {
+			log.Printf("session of user %s expired after %s\n", u.ID, resumeGrace)
+			u.Close()
+		}
+	})
+	u.connMtx.Unlock()
+	log.Printf("user %s disconnected, waiting %s for resume\n", u.ID, resumeGrace)
+}
+
+// attach привязывает к пользователю новый WebSocket и запускает для него WritePump.
+// если старое соединение ещё считается живым (полуоткрытый TCP), оно закрывается.
+// возвращает false, если пользователь уже закрыт
+func (u *User) attach(conn *websocket.Conn) bool {
+	u.connMtx.Lock()
+	defer u.connMtx.Unlock()
+	select {
+	case <-u.done:
+		return false
+	default:
+	}
+	if u.graceTimer != nil {
+		u.graceTimer.Stop()
+		u.graceTimer = nil
+	}
+	if !u.detached {
+		close(u.connDone)
+		_ = u.Conn.Close()
+	}
+	// всё, что осталось в очереди от старого соединения, устарело: клиент получит снимок в resumed
+	for len(u.send) > 0 {
+		select {
+		case <-u.send:
+		default:
+		}
+	}
+	u.Conn = conn
+	u.connDone = make(chan struct{})
+	u.connGen++
+	u.detached = false
+	go u.WritePump(conn, u.connDone)
+	return true
+}
+
+// isDetached сообщает, ждёт ли пользователь возобновления сессии
+func (u *User) isDetached() bool {
+	u.connMtx.Lock()
+	defer u.connMtx.Unlock()
+	return u.detached
+}
+
+// resumeSession обрабатывает первое сообщение resume: проверяет JWT и токен сессии,
+// привязывает conn к существующему пользователю и синхронизирует клиента
+func resumeSession(conn *websocket.Conn, msg SignalMessage) {
+	uid, _, err := auth.ParseToken(msg.Token)
+	if err != nil {
+		log.Println("resume with invalid token:", err)
+		sessionResumesTotal.WithLabelValues("unauthorized").Inc()
+		rejectJoin(conn, msg.ID, CodeUnauthorized, "invalid token")
+		return
+	}
+	resumableMtx.Lock()
+	u := resumable[msg.Session]
+	resumableMtx.Unlock()
+	if u == nil || u.ID != uid || !u.attach(conn) {
+		sessionResumesTotal.WithLabelValues("expired").Inc()
+		rejectJoin(conn, msg.ID, CodeSessionExpired, "session expired, join again")
+		return
+	}
+	sessionResumesTotal.WithLabelValues("ok").Inc()
+	log.Printf("user %s resumed session\n", u.ID)
+
+	room := u.room.Load()
+	if room != nil {
+		// снимок комнаты вместо событий, пропущенных за время обрыва
+		peers := []Participant{}
+		room.IterateUsers(func(other *User) {
+			if other != u {
+				peers = append(peers, other.participant())
+			}
+		})
+		_ = u.Send(SignalMessage{Type: TypeResumed, Version: ProtocolVersion, Room: room.ID, To: u.ID, DisplayName: u.DisplayName, Session: u.session, Peers: peers})
+		if rec := room.activeRecorder(); rec != nil {
+			_ = u.Send(SignalMessage{Type: TypeRecordingStarted, Room: room.ID, From: rec.startedBy})
+		}
+		// кто сейчас за слотами last-N и кто активный спикер: смены за время обрыва клиент пропустил
+		u.outMtx.RLock()
+		slots := u.slots
+		u.outMtx.RUnlock()
+		for _, s := range slots {
+			_ = u.Send(SignalMessage{Type: TypeSlot, Slot: s.id, From: s.source()})
+		}
+		room.mtx.RLock()
+		speaker := room.activeSpeaker
+		room.mtx.RUnlock()
+		if speaker != "" {
+			_ = u.Send(SignalMessage{Type: TypeActiveSpeaker, From: speaker})
+		}
+	}
+	u.reply(msg, nil)
+
+	// ICE перезапускаем, если клиент попросил или соединение за время обрыва деградировало;
+	// неотвеченный offer сервера мог потеряться — отправляем его заново
+	pc := u.pc.Load()
+	if pc != nil {
+		state := pc.ICEConnectionState()
+		if msg.ICERestart || state == webrtc.ICEConnectionStateDisconnected || state == webrtc.ICEConnectionStateFailed {
+			u.restartICE()
+		} else {
+			u.resendPendingOffer()
+		}
+	}
+
+	go u.ReadPump(conn)
+}
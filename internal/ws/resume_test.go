@@ -0,0 +1,148 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"voicechat/internal/auth"
+)
+
+// resumableUser заводит участника WebSocket с токеном сессии в комнате roomID и читает его roster
+func resumableUser(t *testing.T, roomID string) *User {
+	t.Helper()
+	conn, client := wsPair(t)
+	u := NewUser(conn, nil)
+	u.ID = "bob"
+	u.account = "bob"
+	u.session = newSessionToken()
+	if err := joinRoom(u, roomID, 0); err != nil {
+		t.Fatal(err)
+	}
+	rememberSession(u)
+	t.Cleanup(u.Close)
+	go u.WritePump(conn, u.connDone)
+	if msg := readSignal(t, client); msg.Type != TypeRoster {
+		t.Fatalf("first message %+v, want roster", msg)
+	}
+	return u
+}
+
+// после resume клиент получает снимок комнаты, слоты и активного спикера,
+// а сообщения, застрявшие в очереди оборванного соединения, до него не доходят
+func TestResumeSession(t *testing.T) {
+	auth.Init()
+	u := resumableUser(t, "resume-room")
+	room := u.room.Load()
+	u.outMtx.Lock()
+	u.slots = []*forwardSlot{{id: "slot-0", src: "alice"}, {id: "slot-1"}}
+	u.outMtx.Unlock()
+	room.mtx.Lock()
+	room.activeSpeaker = "alice"
+	room.mtx.Unlock()
+
+	u.connMtx.Lock()
+	old := u.Conn
+	u.connMtx.Unlock()
+	u.detach(old)
+	if !u.isDetached() {
+		t.Fatal("user not detached after connection loss")
+	}
+	// сообщение, которое WritePump не успел записать в старое соединение
+	u.send <- SignalMessage{Type: TypeSpeaking, From: "stale"}
+
+	token, err := auth.GenerateToken("bob", "bob", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, client := wsPair(t)
+	resumeSession(conn, SignalMessage{Type: TypeResume, ID: "r", Session: u.session, Token: token})
+
+	want := []SignalMessage{
+		{Type: TypeResumed, Version: ProtocolVersion, Room: "resume-room", To: "bob", Session: u.session, Peers: []Participant{}},
+		{Type: TypeSlot, Slot: "slot-0", From: "alice"},
+		{Type: TypeSlot, Slot: "slot-1"},
+		{Type: TypeActiveSpeaker, From: "alice"},
+		{Type: TypeAck, ID: "r"},
+	}
+	for i, w := range want {
+		got := readSignal(t, client)
+		if got.Type != w.Type || got.ID != w.ID || got.Slot != w.Slot || got.From != w.From || got.Room != w.Room || got.To != w.To || got.Session != w.Session {
+			t.Fatalf("message %d:\n got %+v\nwant %+v", i, got, w)
+		}
+	}
+	if u.isDetached() {
+		t.Error("user still detached after resume")
+	}
+}
+
+func TestResumeExpiredSession(t *testing.T) {
+	auth.Init()
+	token, err := auth.GenerateToken("bob", "bob", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, client := wsPair(t)
+	resumeSession(conn, SignalMessage{Type: TypeResume, ID: "r", Session: "unknown", Token: token})
+	if msg := readSignal(t, client); msg.Type != TypeError || msg.Code != CodeSessionExpired {
+		t.Errorf("resume of unknown session: %+v, want %s", msg, CodeSessionExpired)
+	}
+}
+
+// без resume за resumeGrace пользователь уходит из комнаты
+func TestResumeGraceExpires(t *testing.T) {
+	defer func(d time.Duration) { resumeGrace = d }(resumeGrace)
+	resumeGrace = 20 * time.Millisecond
+
+	u := resumableUser(t, "grace-room")
+	u.detach(u.Conn)
+	select {
+	case <-u.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("user not closed after grace period")
+	}
+	if LookupRoom("grace-room") != nil {
+		t.Error("room kept after its only user expired")
+	}
+}
+
+// новое соединение до конца grace period отменяет уход
+func TestAttachCancelsGrace(t *testing.T) {
+	defer func(d time.Duration) { resumeGrace = d }(resumeGrace)
+	resumeGrace = 50 * time.Millisecond
+
+	u := resumableUser(t, "attach-room")
+	u.detach(u.Conn)
+	conn, _ := wsPair(t)
+	if !u.attach(conn) {
+		t.Fatal("attach to a detached user failed")
+	}
+	time.Sleep(2 * resumeGrace)
+	select {
+	case <-u.done:
+		t.Fatal("user closed although it resumed in time")
+	default:
+	}
+	if u.isDetached() {
+		t.Error("user still detached")
+	}
+
+	u.Close()
+	other, _ := wsPair(t)
+	if u.attach(other) {
+		t.Error("attach to a closed user succeeded")
+	}
+}
+
+// пока WebSocket оборван и ждёт resume, сообщения отбрасываются, а не копятся до переполнения
+func TestSendWhileDetached(t *testing.T) {
+	u := NewUser(nil, nil)
+	u.detached = true
+	for i := 0; i < 2*sendQueueSize; i++ {
+		if err := u.Send(SignalMessage{Type: TypeSpeaking}); err != nil {
+			t.Fatalf("send %d while detached: %v", i, err)
+		}
+	}
+	if n := len(u.send); n != 0 {
+		t.Errorf("%d messages queued while detached", n)
+	}
+}
@@ -1,15 +1,40 @@
 package ws
 
 import (
+	"errors"
 	"log"
 	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
 )
 
 // экземпляр комнаты, хранит подключенных юзеров
 type Room struct {
 	ID    string
 	users map[string]*User
-	mtx   sync.RWMutex
+	// tracks - реестр активных источников комнаты
+	// ключ srcID - (id отправителя), значение - его входящий TrackRemote
+	// нужен, чтобы подписать на уже говорящих тех, кто зашёл позже
+	tracks map[string]*webrtc.TrackRemote
+	// lastN - размер пула слотов пересылки у каждого получателя (режим last-N, см. lastn.go);
+	// 0 - каждый источник пересылается отдельным треком. берётся из БД при создании комнаты в памяти
+	// (первым входом) и до её удаления не меняется
+	lastN int
+	// recorder - идущая запись комнаты, nil - записи нет (см. recorder.go)
+	recorder *roomRecorder
+	// mix - сведение для получателей в режиме mixed, nil - таких получателей нет (см. mcu.go)
+	mix *roomMix
+	// activeSpeaker - id самого громкого говорящего (см. vad.go)
+	activeSpeaker string
+	// muted - пользователи (account), заглушённые модератором (см. moderation.go).
+	// хранится в комнате, а не в User: перезаход или вторая сессия заглушённого не снимает mute
+	muted map[string]bool
+	// created - время создания; пустую комнату reaper удаляет не сразу (см. keepalive.go)
+	created time.Time
+	// done закрывается, когда комната удалена из rooms; останавливает фоновые горутины комнаты
+	done chan struct{}
+	mtx  sync.RWMutex
 }
 
 var (
@@ -18,8 +43,47 @@ var (
 	roomsMtx sync.RWMutex
 )
 
-// GetOrCreateRoom возвращает существующую комнату или создаёт новую.
-func GetOrCreateRoom(id string) *Room {
+// RoomInfo — краткая информация об активной комнате для REST API
+type RoomInfo struct {
+	ID           string `json:"id"`
+	Participants int    `json:"participants"`
+}
+
+// Participant — участник активной комнаты
+type Participant struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+	Muted       bool   `json:"muted,omitempty"` // заглушён модератором
+}
+
+// ListRooms возвращает снимок активных комнат с числом участников
+func ListRooms() []RoomInfo {
+	roomsMtx.RLock()
+	rs := make([]*Room, 0, len(rooms))
+	for _, r := range rooms {
+		rs = append(rs, r)
+	}
+	roomsMtx.RUnlock()
+
+	out := make([]RoomInfo, 0, len(rs))
+	for _, r := range rs {
+		r.mtx.RLock()
+		out = append(out, RoomInfo{ID: r.ID, Participants: len(r.users)})
+		r.mtx.RUnlock()
+	}
+	return out
+}
+
+// LookupRoom возвращает активную комнату по id или nil, если в ней сейчас никого нет
+func LookupRoom(id string) *Room {
+	roomsMtx.RLock()
+	defer roomsMtx.RUnlock()
+	return rooms[id]
+}
+
+// GetOrCreateRoom возвращает существующую комнату или создаёт новую с пулом из lastN слотов
+// (настройка комнаты из БД, см. store.Room.LastN); у существующей комнаты lastN не меняется.
+func GetOrCreateRoom(id string, lastN int) *Room {
 	// исп. lock вместо rlock, тк может произойти создание комнаты
 	roomsMtx.Lock()
 	defer roomsMtx.Unlock()
@@ -28,12 +92,27 @@ func GetOrCreateRoom(id string) *Room {
 	}
 	// если комнаты нет, создаем
 	r := &Room{
-		ID:    id,
-		users: make(map[string]*User),
+		ID:      id,
+		users:   make(map[string]*User),
+		tracks:  make(map[string]*webrtc.TrackRemote),
+		muted:   make(map[string]bool),
+		lastN:   lastN,
+		created: time.Now(),
+		done:    make(chan struct{}),
 	}
 	// заносим комнату по id в мапу
 	rooms[id] = r
-	log.Println("created room:", id)
+	if lastN > 0 {
+		log.Printf("created room: %s (last-%d)\n", id, lastN)
+	} else {
+		log.Println("created room:", id)
+	}
+	// детектор речи и рассылка speaking/activeSpeaker
+	go r.runVAD()
+	// периодическая рассылка статистики соединений
+	if statsPushInterval > 0 {
+		go r.runStats()
+	}
 	return r
 }
 
@@ -47,40 +126,172 @@ func (r *Room) HasUser(id string) bool {
 	return ok
 }
 
-// AddUser пытается добавить пользователя в комнату (атомарно благодаря mtx)
-func (r *Room) AddUser(u *User) bool {
+// GetUser возвращает участника комнаты по id или nil
+func (r *Room) GetUser(id string) *User {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.users[id]
+}
+
+// errRoomClosed — комнату удалили (опустела), пока в неё входили: нужно взять свежую (см. joinRoom)
+var errRoomClosed = errors.New("room closed")
+
+// joinRoom добавляет u в активную комнату id, создавая её с пулом lastN слотов, если её нет.
+// пустую комнату могут удалить (последний вышел, reaper) между GetOrCreateRoom и AddUser —
+// тогда вход повторяется в новой комнате с тем же id. свежую комнату удалить некому:
+// в ней никого нет, а reaper не трогает только что созданные
+func joinRoom(u *User, id string, lastN int) error {
+	for {
+		err := GetOrCreateRoom(id, lastN).AddUser(u)
+		if !errors.Is(err, errRoomClosed) {
+			return err
+		}
+		log.Printf("room %s closed while user %s was joining, retrying\n", id, u.ID)
+	}
+}
+
+// AddUser пытается добавить пользователя в комнату (атомарно благодаря mtx).
+// новичок получает снимок участников (roster), остальные — событие peerJoined.
+// возвращает ErrAlreadyJoined, если пользователь уже в комнате, и errRoomClosed,
+// если комнату успели удалить из rooms (см. joinRoom)
+func (r *Room) AddUser(u *User) error {
 	r.mtx.Lock()
-	defer r.mtx.Unlock()
+	// комната удаляется под r.mtx (RemoveUser, reap) с закрытием done — после этого в неё не входят
+	select {
+	case <-r.done:
+		r.mtx.Unlock()
+		return errRoomClosed
+	default:
+	}
 	// проверяем что юзера еще нет в мапе юзеров этой комнаты
 	if _, exists := r.users[u.ID]; exists {
-		return false
+		r.mtx.Unlock()
+		return ErrAlreadyJoined
+	}
+	// снимок тех, кто уже в комнате — для roster новичку и рассылки peerJoined
+	others := make([]*User, 0, len(r.users))
+	for _, other := range r.users {
+		others = append(others, other)
 	}
 	// добавляем пользователя в мапу юзеров по id
 	r.users[u.ID] = u
+	// mute, выставленный модератором раньше, действует и на новую сессию
+	u.muted.Store(r.muted[u.account])
 	// присваеваем ему комнату, в которой находиться
-	u.room = r
+	u.room.Store(r)
 	log.Printf("user \"%s\" joined room %s (now %d users)\n", u.DisplayName, r.ID, len(r.users))
-	return true
+	r.mtx.Unlock()
+
+	// roster: кто уже в комнате; To/DisplayName — id и имя самого новичка, чтобы клиент знал себя
+	peers := make([]Participant, 0, len(others))
+	for _, other := range others {
+		peers = append(peers, other.participant())
+	}
+	if err := u.Send(SignalMessage{Type: TypeRoster, Version: ProtocolVersion, Room: r.ID, To: u.ID, DisplayName: u.DisplayName, Session: u.session, Peers: peers}); err != nil {
+		log.Println("send roster:", err)
+	}
+	// новичок должен знать, что его заглушили (остальные видят это в его Participant)
+	if u.muted.Load() {
+		_ = u.Send(SignalMessage{Type: TypeMute, To: u.ID})
+	}
+	// новичок должен знать, что комнату записывают
+	if rec := r.activeRecorder(); rec != nil {
+		_ = u.Send(SignalMessage{Type: TypeRecordingStarted, Room: r.ID, From: rec.startedBy})
+	}
+	// остальным сообщаем о новом участнике
+	for _, other := range others {
+		if err := other.Send(SignalMessage{Type: TypePeerJoined, From: u.ID, DisplayName: u.DisplayName}); err != nil {
+			log.Println("send peerJoined:", err)
+		}
+		if u.muted.Load() {
+			_ = other.Send(SignalMessage{Type: TypeMute, To: u.ID})
+		}
+	}
+	return nil
 }
 
 // RemoveUser удаляет пользователя из комнаты и при пустой комнате удаляет
 // саму комнату из глобальной таблицы rooms.
+// у оставшихся участников снимаются треки ушедшего источника, запускается renegotiation
+// и отправляется сигнал peerLeft, чтобы клиент убрал audio-элемент.
 func (r *Room) RemoveUser(u *User) {
 	r.mtx.Lock()
-	defer r.mtx.Unlock()
 	// удаляет юзера из мапы юзеров комнаты по id
 	delete(r.users, u.ID)
+	// источник ушёл - убираем его из реестра треков
+	delete(r.tracks, u.ID)
+	if r.activeSpeaker == u.ID {
+		r.activeSpeaker = ""
+	}
+	rec := r.recorder
 	// у юзера обнуляет комнату
-	u.room = nil
+	u.room.Store(nil)
+	leavesTotal.Inc()
 	log.Printf("user \"%s\" left room %s (now %d users)\n", u.DisplayName, r.ID, len(r.users))
+	// снимок оставшихся юзеров, с ними работаем уже без блокировки комнаты
+	rest := make([]*User, 0, len(r.users))
+	for _, other := range r.users {
+		rest = append(rest, other)
+	}
 	// если в комнате 0 юзеров - удаляем комнату
 	if len(r.users) == 0 {
 		roomsMtx.Lock()
-		// удаляем room из глобальной мапы
-		delete(rooms, r.ID)
+		// удаляем room из глобальной мапы (если под этим id ещё эта комната)
+		removed := rooms[r.ID] == r
+		if removed {
+			delete(rooms, r.ID)
+		}
 		roomsMtx.Unlock()
-		log.Printf("room %s removed (empty)\n", r.ID)
+		if removed {
+			// останавливаем фоновые горутины комнаты
+			close(r.done)
+			log.Printf("room %s removed (empty)\n", r.ID)
+		}
+	}
+	r.mtx.Unlock()
+
+	// ушедший больше не звучит в сведении; если получателей mixed не осталось — сведение останавливается
+	r.releaseMix(u, rest)
+
+	// запись ушедшего закрываем; если комната опустела — запись останавливается целиком
+	if rec != nil {
+		if len(rest) == 0 {
+			_ = r.StopRecording("")
+		} else {
+			rec.closeSource(u.ID)
+		}
+	}
+
+	for _, other := range rest {
+		// снимаем трек ушедшего источника и, если он был, пересогласовываем SDP
+		if other.removeOutgoingTrack(u.ID) {
+			go other.Negotiate()
+		}
+		// сообщаем клиенту, что участник ушёл
+		if err := other.Send(SignalMessage{Type: TypePeerLeft, From: u.ID, DisplayName: u.DisplayName}); err != nil {
+			log.Println("send peerLeft:", err)
+		}
+	}
+}
+
+// setMuted заглушает (или снимает mute) пользователя account во всех его сессиях в комнате,
+// в том числе будущих (см. AddUser). возвращает его сессии, которые сейчас в комнате
+func (r *Room) setMuted(account string, muted bool) []*User {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if muted {
+		r.muted[account] = true
+	} else {
+		delete(r.muted, account)
 	}
+	var sessions []*User
+	for _, u := range r.users {
+		if u.account == account {
+			u.muted.Store(muted)
+			sessions = append(sessions, u)
+		}
+	}
+	return sessions
 }
 
 // IterateUsers создаёт "снимок" пользователей под RLock в текущий момент и вызывает
@@ -100,3 +311,82 @@ func (r *Room) IterateUsers(fn func(u *User)) {
 		fn(u)
 	}
 }
+
+// AddTrack регистрирует входящий трек источника srcID в реестре комнаты
+func (r *Room) AddTrack(srcID string, t *webrtc.TrackRemote) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.tracks[srcID] = t
+}
+
+// RemoveTrack убирает трек источника из реестра.
+// удаляем только если в реестре лежит именно этот трек, чтобы не затереть более новый
+// (например, после повторного offer от того же пользователя)
+func (r *Room) RemoveTrack(srcID string, t *webrtc.TrackRemote) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if cur, ok := r.tracks[srcID]; ok && cur == t {
+		delete(r.tracks, srcID)
+	}
+}
+
+// SubscribeToExisting подписывает пользователя на все активные источники комнаты:
+// создаёт для него локальные треки, добавляет их в его PeerConnection и запускает renegotiation.
+// вызывается, когда PeerConnection новичка готов, иначе опоздавшие не слышат тех, кто уже говорит.
+// в режиме last-N вместо этого создаётся пул слотов, источники в них раскладывает runVAD,
+// а получателю в режиме mixed — один трек сведения (см. mcu.go)
+func (r *Room) SubscribeToExisting(u *User) {
+	if u.mixed {
+		if u.addMixTrack() {
+			r.attachMix(u)
+			go u.Negotiate()
+		}
+		return
+	}
+	if r.lastN > 0 {
+		if u.addSlots(r.lastN) {
+			go u.Negotiate()
+		}
+		return
+	}
+
+	// снимок реестра под RLock, сами треки добавляем без блокировки комнаты
+	r.mtx.RLock()
+	srcs := make(map[string]*webrtc.TrackRemote, len(r.tracks))
+	for id, t := range r.tracks {
+		srcs[id] = t
+	}
+	r.mtx.RUnlock()
+
+	added := false
+	for srcID, t := range srcs {
+		// свой собственный трек пользователю не пересылаем
+		if srcID == u.ID {
+			continue
+		}
+		if u.addOutgoingTrack(srcID, t.Codec().RTPCodecCapability) {
+			added = true
+		}
+	}
+	// renegotiation нужна только если набор треков действительно изменился
+	if added {
+		go u.Negotiate()
+	}
+}
+
+// Participants возвращает снимок участников комнаты
+func (r *Room) Participants() []Participant {
+	out := []Participant{}
+	r.IterateUsers(func(u *User) {
+		out = append(out, u.participant())
+	})
+	return out
+}
+
+// Close отключает всех участников комнаты; после ухода последнего комната
+// удаляется из глобальной таблицы rooms (см. RemoveUser)
+func (r *Room) Close() {
+	r.IterateUsers(func(u *User) {
+		u.Close()
+	})
+}
@@ -0,0 +1,85 @@
+package ws
+
+import (
+	"errors"
+	"testing"
+)
+
+// closeRoom удаляет пустую комнату так же, как RemoveUser и reap
+func closeRoom(r *Room) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	roomsMtx.Lock()
+	delete(rooms, r.ID)
+	roomsMtx.Unlock()
+	close(r.done)
+}
+
+func TestAddUserToClosedRoom(t *testing.T) {
+	r := GetOrCreateRoom("closed-room", 0)
+	closeRoom(r)
+
+	u := NewUser(nil, nil)
+	if err := r.AddUser(u); !errors.Is(err, errRoomClosed) {
+		t.Fatalf("AddUser to closed room: %v, want errRoomClosed", err)
+	}
+	if u.room.Load() != nil {
+		t.Error("user attached to a closed room")
+	}
+}
+
+func TestJoinRoomRetriesWithFreshRoom(t *testing.T) {
+	stale := GetOrCreateRoom("race-room", 0)
+	closeRoom(stale)
+	// комнату удалили — вход создаёт новую с тем же id, а не теряется в старой
+	u := NewUser(nil, nil)
+	if err := joinRoom(u, "race-room", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer closeRoom(u.room.Load())
+	if u.room.Load() == stale {
+		t.Fatal("user joined the closed room")
+	}
+	if LookupRoom("race-room") != u.room.Load() {
+		t.Error("user's room is not the active room")
+	}
+
+	dup := NewUser(nil, nil)
+	dup.ID = u.ID
+	if err := joinRoom(dup, "race-room", 0); !errors.Is(err, ErrAlreadyJoined) {
+		t.Errorf("second join: %v, want ErrAlreadyJoined", err)
+	}
+}
+
+// mute модератора хранится в комнате по пользователю и переживает переподключение
+func TestMuteSurvivesRejoin(t *testing.T) {
+	r := GetOrCreateRoom("mute-room", 0)
+	defer closeRoom(r)
+	// второй участник держит комнату открытой, пока bob переподключается
+	if err := r.AddUser(NewUser(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	first := NewUser(nil, nil)
+	first.account = "bob"
+	if err := r.AddUser(first); err != nil {
+		t.Fatal(err)
+	}
+	if sessions := r.setMuted("bob", true); len(sessions) != 1 || sessions[0] != first {
+		t.Fatalf("setMuted sessions = %v, want the online session", sessions)
+	}
+	r.RemoveUser(first)
+
+	again := NewUser(nil, nil)
+	again.account = "bob"
+	if err := r.AddUser(again); err != nil {
+		t.Fatal(err)
+	}
+	if !again.muted.Load() || !again.participant().Muted {
+		t.Error("rejoined user is not muted")
+	}
+	r.setMuted("bob", false)
+	if again.muted.Load() {
+		t.Error("unmute did not reach the online session")
+	}
+}
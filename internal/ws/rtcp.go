@@ -0,0 +1,279 @@
+package ws
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// RTCP: NACK обрабатывают интерсепторы pion (см. api.go) — generator запрашивает у клиента-источника
+// потерянные пакеты, responder переотправляет получателям пакеты из своего буфера.
+// чтобы интерсепторы работали, RTCP нужно вычитывать из каждого RTPReceiver и RTPSender,
+// иначе их буферы заполняются. попутно отсюда берутся отчёты о качестве путей.
+
+// PathStats — качество одного RTP-пути
+type PathStats struct {
+	PacketsLost  int64     `json:"packetsLost"`     // потеряно пакетов за всё время
+	FractionLost float64   `json:"fractionLost"`    // доля потерь за последний интервал, 0..1
+	JitterMs     float64   `json:"jitterMs"`        // межпакетный джиттер (RFC 3550), мс
+	RTTMs        float64   `json:"rttMs,omitempty"` // round-trip time по RTCP SR/RR, мс
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// MediaStats — качество путей пользователя
+type MediaStats struct {
+	// Inbound — клиент → сервер (его микрофон), считается сервером по принятым RTP
+	Inbound PathStats `json:"inbound"`
+	// Outbound — сервер → клиент по receiver report'ам клиента; ключ — id источника (или слота в режиме last-N)
+	Outbound map[string]PathStats `json:"outbound"`
+}
+
+// pathStatsSet — статистика путей пользователя, обновляется из RTP/RTCP циклов
+type pathStatsSet struct {
+	mtx      sync.Mutex
+	in       inboundCounter
+	outbound map[string]PathStats
+}
+
+// MediaStats возвращает снимок статистики путей пользователя
+func (u *User) MediaStats() MediaStats {
+	u.stats.mtx.Lock()
+	defer u.stats.mtx.Unlock()
+	out := MediaStats{
+		Inbound:  u.stats.in.snapshot(),
+		Outbound: make(map[string]PathStats, len(u.stats.outbound)),
+	}
+	for k, v := range u.stats.outbound {
+		out.Outbound[k] = v
+	}
+	return out
+}
+
+// setOutbound обновляет статистику пути сервер → клиент для источника key
+func (u *User) setOutbound(key string, ps PathStats) {
+	u.stats.mtx.Lock()
+	defer u.stats.mtx.Unlock()
+	if u.stats.outbound == nil {
+		u.stats.outbound = make(map[string]PathStats)
+	}
+	u.stats.outbound[key] = ps
+}
+
+// deleteOutbound убирает статистику снятого пути
+func (u *User) deleteOutbound(key string) {
+	u.stats.mtx.Lock()
+	defer u.stats.mtx.Unlock()
+	delete(u.stats.outbound, key)
+}
+
+// observeInbound учитывает принятый от клиента RTP-пакет в статистике входящего пути
+func (u *User) observeInbound(pkt *rtp.Packet, clockRate uint32, now time.Time) {
+	u.stats.mtx.Lock()
+	defer u.stats.mtx.Unlock()
+	u.stats.in.observe(pkt, clockRate, now)
+}
+
+// inboundCounter — потери и джиттер входящего потока по RFC 3550 (A.1, A.3, A.8)
+type inboundCounter struct {
+	started  bool
+	start    time.Time // точка отсчёта времени прихода в единицах RTP clock
+	baseSeq  uint16
+	maxSeq   uint16
+	cycles   uint32 // число переполнений seq (старшие биты расширенного номера)
+	received uint64
+
+	transit int64   // прошлое значение (время прихода - RTP timestamp)
+	jitter  float64 // в единицах RTP clock
+	rate    uint32
+
+	// интервал для FractionLost
+	intervalAt    time.Time
+	expectedPrior uint64
+	receivedPrior uint64
+	fractionLost  float64
+	lastPacketAt  time.Time
+}
+
+// statsInterval — интервал, за который считается доля потерь входящего потока
+const statsInterval = time.Second
+
+func (c *inboundCounter) observe(pkt *rtp.Packet, clockRate uint32, now time.Time) {
+	seq := pkt.SequenceNumber
+	if !c.started {
+		c.started = true
+		c.start, c.intervalAt = now, now
+		c.baseSeq, c.maxSeq = seq, seq
+		c.rate = clockRate
+	} else if delta := seq - c.maxSeq; delta != 0 && delta < 1<<15 {
+		// пакет новее максимального; меньший номер после большого — переполнение seq
+		if seq < c.maxSeq {
+			c.cycles += 1 << 16
+		}
+		c.maxSeq = seq
+	}
+	c.received++
+	c.lastPacketAt = now
+
+	// джиттер: разница времени пересылки соседних пакетов, сглаженная с весом 1/16
+	if c.rate > 0 {
+		arrival := int64(now.Sub(c.start).Seconds() * float64(c.rate))
+		transit := arrival - int64(pkt.Timestamp)
+		if c.received > 1 {
+			d := transit - c.transit
+			if d < 0 {
+				d = -d
+			}
+			c.jitter += (float64(d) - c.jitter) / 16
+		}
+		c.transit = transit
+	}
+
+	// доля потерь за интервал statsInterval
+	if now.Sub(c.intervalAt) >= statsInterval {
+		expected := c.expected()
+		expInterval := expected - c.expectedPrior
+		recvInterval := c.received - c.receivedPrior
+		c.fractionLost = 0
+		if expInterval > 0 && expInterval > recvInterval {
+			c.fractionLost = float64(expInterval-recvInterval) / float64(expInterval)
+		}
+		c.expectedPrior, c.receivedPrior, c.intervalAt = expected, c.received, now
+	}
+}
+
+// expected — сколько пакетов должно было прийти по номерам seq
+func (c *inboundCounter) expected() uint64 {
+	return uint64(c.cycles) + uint64(c.maxSeq) - uint64(c.baseSeq) + 1
+}
+
+func (c *inboundCounter) snapshot() PathStats {
+	if !c.started {
+		return PathStats{}
+	}
+	ps := PathStats{FractionLost: c.fractionLost, UpdatedAt: c.lastPacketAt}
+	if lost := int64(c.expected()) - int64(c.received); lost > 0 {
+		ps.PacketsLost = lost
+	}
+	if c.rate > 0 {
+		ps.JitterMs = c.jitter / float64(c.rate) * 1000
+	}
+	return ps
+}
+
+// readReceiverRTCP вычитывает RTCP входящего трека клиента (sender report'ы),
+// чтобы интерсепторы получали его и не копили буфер. завершается вместе с треком
+func readReceiverRTCP(receiver *webrtc.RTPReceiver) {
+	for {
+		if _, _, err := receiver.ReadRTCP(); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Println("receiver.ReadRTCP:", err)
+			}
+			return
+		}
+	}
+}
+
+// readSenderRTCP вычитывает RTCP от клиента по исходящему треку key (источник или слот):
+// receiver report'ы идут в статистику пути, запросы ключевого кадра (PLI/FIR) передаются
+// источнику. source возвращает id источника, который сейчас пишет в этот трек.
+// завершается, когда sender остановлен (RemoveTrack или закрытие PeerConnection)
+func (u *User) readSenderRTCP(key string, sender *webrtc.RTPSender, clockRate uint32, source func() string) {
+	defer u.deleteOutbound(key)
+
+	var ssrc uint32
+	if enc := sender.GetParameters().Encodings; len(enc) > 0 {
+		ssrc = uint32(enc[0].SSRC)
+	}
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Println("sender.ReadRTCP:", err)
+			}
+			return
+		}
+		now := time.Now()
+		for _, p := range pkts {
+			switch p := p.(type) {
+			case *rtcp.ReceiverReport:
+				u.applyReports(key, p.Reports, ssrc, clockRate, now)
+			case *rtcp.SenderReport:
+				u.applyReports(key, p.Reports, ssrc, clockRate, now)
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if room := u.room.Load(); room != nil {
+					room.requestKeyframe(source())
+				}
+			}
+		}
+	}
+}
+
+// applyReports переносит reception report'ы клиента о треке ssrc в статистику пути key
+func (u *User) applyReports(key string, reports []rtcp.ReceptionReport, ssrc, clockRate uint32, now time.Time) {
+	for _, r := range reports {
+		if ssrc != 0 && r.SSRC != ssrc {
+			continue
+		}
+		ps := PathStats{
+			PacketsLost:  int64(r.TotalLost),
+			FractionLost: float64(r.FractionLost) / 256,
+			UpdatedAt:    now,
+		}
+		if clockRate > 0 {
+			ps.JitterMs = float64(r.Jitter) / float64(clockRate) * 1000
+		}
+		if rtt, ok := reportRTT(r, now); ok {
+			ps.RTTMs = float64(rtt) / float64(time.Millisecond)
+		}
+		u.setOutbound(key, ps)
+	}
+}
+
+// reportRTT считает RTT по RFC 3550 6.4.1: now - LSR - DLSR в формате NTP 16.16.
+// LSR=0 — клиент ещё не получал от нас sender report
+func reportRTT(r rtcp.ReceptionReport, now time.Time) (time.Duration, bool) {
+	if r.LastSenderReport == 0 {
+		return 0, false
+	}
+	rtt := ntpCompact(now) - r.LastSenderReport - r.Delay
+	// отрицательная разница (переполнение uint32) — отчёт некорректен
+	if rtt > 1<<31 {
+		return 0, false
+	}
+	return time.Duration(float64(rtt) / 65536 * float64(time.Second)), true
+}
+
+// ntpCompact — средние 32 бита NTP-времени (16 бит секунд, 16 бит дробной части)
+func ntpCompact(t time.Time) uint32 {
+	const ntpEpochOffset = 2208988800 // секунд между 1900 и 1970
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32(secs<<16 | frac>>16)
+}
+
+// requestKeyframe передаёт источнику srcID запрос ключевого кадра (PLI) от получателя
+func (r *Room) requestKeyframe(srcID string) {
+	if srcID == "" {
+		return
+	}
+	r.mtx.RLock()
+	track := r.tracks[srcID]
+	src := r.users[srcID]
+	r.mtx.RUnlock()
+	if track == nil || src == nil {
+		return
+	}
+	pc := src.pc.Load()
+	if pc == nil {
+		return
+	}
+	if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); err != nil {
+		log.Println("WriteRTCP (PLI):", err)
+	}
+}
@@ -0,0 +1,113 @@
+package ws
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// feed подаёт в c пакеты с номерами seqs: 20 мс Opus (960 тиков) на номер, приход — через
+// 20 мс плюс delay(i) от отправки
+func feed(c *inboundCounter, start time.Time, seqs []uint16, delay func(i int) time.Duration) {
+	for i, seq := range seqs {
+		n := int(seq - seqs[0])
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(n) * 960}}
+		c.observe(pkt, 48000, start.Add(time.Duration(n)*20*time.Millisecond+delay(i)))
+	}
+}
+
+func noDelay(int) time.Duration { return 0 }
+
+func TestInboundCounterNoLoss(t *testing.T) {
+	var c inboundCounter
+	seqs := make([]uint16, 100)
+	for i := range seqs {
+		seqs[i] = uint16(1000 + i)
+	}
+	feed(&c, time.Now(), seqs, noDelay)
+
+	ps := c.snapshot()
+	if ps.PacketsLost != 0 || ps.FractionLost != 0 {
+		t.Errorf("lost = %d, fraction = %v; want none", ps.PacketsLost, ps.FractionLost)
+	}
+	// равномерный поток: джиттер с точностью до округления тиков
+	if ps.JitterMs > 0.1 {
+		t.Errorf("jitter = %v ms, want ~0", ps.JitterMs)
+	}
+}
+
+func TestInboundCounterLoss(t *testing.T) {
+	var c inboundCounter
+	// 100 номеров, каждый десятый потерян
+	var seqs []uint16
+	for i := 0; i < 100; i++ {
+		if i%10 != 5 {
+			seqs = append(seqs, uint16(i))
+		}
+	}
+	feed(&c, time.Now(), seqs, noDelay)
+
+	ps := c.snapshot()
+	if ps.PacketsLost != 10 {
+		t.Errorf("lost = %d, want 10", ps.PacketsLost)
+	}
+	// первый интервал statsInterval закрывается на пакете 50: 51 ожидался, 46 пришло
+	if math.Abs(ps.FractionLost-0.1) > 0.01 {
+		t.Errorf("fraction lost = %v, want 0.1", ps.FractionLost)
+	}
+}
+
+func TestInboundCounterSeqWrap(t *testing.T) {
+	var c inboundCounter
+	var seqs []uint16
+	for i := 0; i < 20; i++ {
+		seqs = append(seqs, uint16(65530+i))
+	}
+	feed(&c, time.Now(), seqs, noDelay)
+
+	if got := c.expected(); got != 20 {
+		t.Errorf("expected = %d across wrap, want 20", got)
+	}
+	if ps := c.snapshot(); ps.PacketsLost != 0 {
+		t.Errorf("lost = %d across wrap, want 0", ps.PacketsLost)
+	}
+}
+
+func TestInboundCounterReorderAndDuplicate(t *testing.T) {
+	var c inboundCounter
+	// 3 и 2 переставлены, 4 повторён: номера 1..5 все дошли
+	feed(&c, time.Now(), []uint16{1, 3, 2, 4, 4, 5}, noDelay)
+
+	if got := c.expected(); got != 5 {
+		t.Errorf("expected = %d, want 5", got)
+	}
+	if ps := c.snapshot(); ps.PacketsLost != 0 {
+		t.Errorf("lost = %d, want 0", ps.PacketsLost)
+	}
+}
+
+func TestInboundCounterJitter(t *testing.T) {
+	var c inboundCounter
+	seqs := make([]uint16, 200)
+	for i := range seqs {
+		seqs[i] = uint16(i)
+	}
+	// приход чередуется: вовремя и с опозданием на 10 мс — |D| = 10 мс на каждом пакете
+	feed(&c, time.Now(), seqs, func(i int) time.Duration {
+		return time.Duration(i%2) * 10 * time.Millisecond
+	})
+
+	// оценка RFC 3550 сходится к среднему |D|
+	if ps := c.snapshot(); math.Abs(ps.JitterMs-10) > 0.5 {
+		t.Errorf("jitter = %v ms, want ~10", ps.JitterMs)
+	}
+}
+
+func TestInboundCounterEmpty(t *testing.T) {
+	var c inboundCounter
+	if ps := c.snapshot(); ps != (PathStats{}) {
+		t.Errorf("snapshot before packets = %+v, want zero", ps)
+	}
+}
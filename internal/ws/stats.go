@@ -0,0 +1,235 @@
+package ws
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// CandidateInfo — один конец выбранной ICE-пары
+type CandidateInfo struct {
+	Type     string `json:"type"`     // host, srflx, prflx, relay
+	Protocol string `json:"protocol"` // udp, tcp
+	Address  string `json:"address"`  // ip:port
+}
+
+// CandidatePairInfo — ICE-пара, через которую идёт трафик пользователя
+type CandidatePairInfo struct {
+	Local  CandidateInfo `json:"local"`
+	Remote CandidateInfo `json:"remote"`
+	State  string        `json:"state"`
+}
+
+// ParticipantStats — качество соединения участника для диагностики (по pion GetStats)
+type ParticipantStats struct {
+	ID            string             `json:"id"`
+	DisplayName   string             `json:"displayName"`
+	CandidatePair *CandidatePairInfo `json:"candidatePair,omitempty"`
+	RTTMs         float64            `json:"rttMs"`        // RTT по STUN-проверкам выбранной пары (или по RTCP, если их ещё нет)
+	PacketsLost   int64              `json:"packetsLost"`  // потери входящего аудио клиента
+	FractionLost  float64            `json:"fractionLost"` // доля потерь по отчётам клиента о наших потоках, 0..1
+	JitterMs      float64            `json:"jitterMs"`     // джиттер входящего аудио клиента
+	BitrateIn     float64            `json:"bitrateIn"`    // бит/с от клиента к серверу
+	BitrateOut    float64            `json:"bitrateOut"`   // бит/с от сервера к клиенту
+	Codec         string             `json:"codec,omitempty"`
+	Paths         MediaStats         `json:"paths"` // детально по путям (см. rtcp.go)
+}
+
+// RoomStats — статистика всех участников комнаты и агрегаты по ней
+type RoomStats struct {
+	Room         string             `json:"room"`
+	Participants []ParticipantStats `json:"participants"`
+	BitrateIn    float64            `json:"bitrateIn"`   // суммарно от клиентов
+	BitrateOut   float64            `json:"bitrateOut"`  // суммарно к клиентам
+	AvgRTTMs     float64            `json:"avgRttMs"`    // среднее RTT участников с известным RTT
+	MaxJitterMs  float64            `json:"maxJitterMs"` // худший джиттер в комнате
+	PacketsLost  int64              `json:"packetsLost"` // суммарные потери входящего аудио
+	CollectedAt  time.Time          `json:"collectedAt"`
+}
+
+// statsConsumer — кто собирает статистику. у каждого свой замер битрейта,
+// чтобы рассылка и REST-запросы не сбивали друг другу окно
+type statsConsumer int
+
+const (
+	statsPush statsConsumer = iota // периодическая рассылка runStats
+	statsREST                      // GET /api/rooms/{id}/stats
+	statsConsumers
+)
+
+// bitrateMinWindow — минимальное окно замера битрейта: запрос раньше получает прошлое значение,
+// а не битрейт за несколько миллисекунд (например, два модератора опрашивают REST подряд)
+const bitrateMinWindow = time.Second
+
+// bitrateSample — прошлый замер байт выбранной ICE-пары, из разницы считается битрейт
+type bitrateSample struct {
+	mtx      sync.Mutex
+	at       time.Time
+	bytesIn  uint64
+	bytesOut uint64
+	// in, out — битрейт, посчитанный на прошлом окне
+	in, out float64
+}
+
+// rate возвращает битрейт в обе стороны с прошлого замера и запоминает новый.
+// если с прошлого замера прошло меньше bitrateMinWindow, возвращает прошлый битрейт и окно не сдвигает
+func (s *bitrateSample) rate(bytesIn, bytesOut uint64, now time.Time) (in, out float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.at.IsZero() && now.Sub(s.at) < bitrateMinWindow {
+		return s.in, s.out
+	}
+	s.in, s.out = 0, 0
+	if !s.at.IsZero() && bytesIn >= s.bytesIn && bytesOut >= s.bytesOut {
+		if secs := now.Sub(s.at).Seconds(); secs > 0 {
+			s.in = float64(bytesIn-s.bytesIn) * 8 / secs
+			s.out = float64(bytesOut-s.bytesOut) * 8 / secs
+		}
+	}
+	s.at, s.bytesIn, s.bytesOut = now, bytesIn, bytesOut
+	return s.in, s.out
+}
+
+// ConnectionStats собирает статистику соединения пользователя из GetStats его PeerConnection
+// (битрейт — по замеру REST, см. statsConsumer)
+func (u *User) ConnectionStats() ParticipantStats {
+	return u.connectionStats(statsREST)
+}
+
+// connectionStats собирает статистику соединения; битрейт считается от предыдущего замера
+// того же потребителя c, поэтому первый замер даёт 0
+func (u *User) connectionStats(c statsConsumer) ParticipantStats {
+	ps := ParticipantStats{ID: u.ID, DisplayName: u.DisplayName, Paths: u.MediaStats()}
+	pc := u.pc.Load()
+	if pc == nil {
+		return ps
+	}
+	now := time.Now()
+	report := pc.GetStats()
+
+	var pair *webrtc.ICECandidatePairStats
+	for _, s := range report {
+		switch s := s.(type) {
+		case webrtc.ICECandidatePairStats:
+			// выбранная пара — номинированная и успешная
+			if s.Nominated && s.State == webrtc.StatsICECandidatePairStateSucceeded {
+				p := s
+				pair = &p
+			}
+		case webrtc.InboundRTPStreamStats:
+			ps.PacketsLost += int64(s.PacketsLost)
+			if j := s.Jitter * 1000; j > ps.JitterMs {
+				ps.JitterMs = j
+			}
+			if c, ok := report[s.CodecID].(webrtc.CodecStats); ok && ps.Codec == "" {
+				ps.Codec = c.MimeType
+			}
+		}
+	}
+
+	// pion не отдаёт remote-inbound-rtp, поэтому потери и RTT исходящих потоков
+	// берём из receiver report'ов клиента (см. rtcp.go)
+	var (
+		lossSum, rttSum float64
+		lossN, rttN     int
+	)
+	for _, path := range ps.Paths.Outbound {
+		lossSum += path.FractionLost
+		lossN++
+		if path.RTTMs > 0 {
+			rttSum += path.RTTMs
+			rttN++
+		}
+	}
+	if lossN > 0 {
+		ps.FractionLost = lossSum / float64(lossN)
+	}
+
+	if pair != nil {
+		ps.CandidatePair = &CandidatePairInfo{
+			Local:  candidateInfo(report, pair.LocalCandidateID),
+			Remote: candidateInfo(report, pair.RemoteCandidateID),
+			State:  string(pair.State),
+		}
+		ps.RTTMs = pair.CurrentRoundTripTime * 1000
+		ps.BitrateIn, ps.BitrateOut = u.bitrate[c].rate(pair.BytesReceived, pair.BytesSent, now)
+	}
+	if ps.RTTMs == 0 && rttN > 0 {
+		ps.RTTMs = rttSum / float64(rttN)
+	}
+	return ps
+}
+
+// candidateInfo находит в отчёте локального или удалённого ICE-кандидата по id
+func candidateInfo(report webrtc.StatsReport, id string) CandidateInfo {
+	c, ok := report[id].(webrtc.ICECandidateStats)
+	if !ok {
+		return CandidateInfo{}
+	}
+	return CandidateInfo{
+		Type:     c.CandidateType.String(),
+		Protocol: c.Protocol,
+		Address:  net.JoinHostPort(c.IP, strconv.Itoa(int(c.Port))),
+	}
+}
+
+// Stats собирает статистику всех участников комнаты с агрегатами (для REST)
+func (r *Room) Stats() RoomStats {
+	return r.collectStats(statsREST)
+}
+
+// collectStats собирает статистику комнаты для потребителя c
+func (r *Room) collectStats(c statsConsumer) RoomStats {
+	rs := RoomStats{Room: r.ID, Participants: []ParticipantStats{}, CollectedAt: time.Now()}
+	var (
+		rttSum float64
+		rttN   int
+	)
+	r.IterateUsers(func(u *User) {
+		ps := u.connectionStats(c)
+		rs.Participants = append(rs.Participants, ps)
+		rs.BitrateIn += ps.BitrateIn
+		rs.BitrateOut += ps.BitrateOut
+		rs.PacketsLost += ps.PacketsLost
+		if ps.JitterMs > rs.MaxJitterMs {
+			rs.MaxJitterMs = ps.JitterMs
+		}
+		if ps.RTTMs > 0 {
+			rttSum += ps.RTTMs
+			rttN++
+		}
+	})
+	if rttN > 0 {
+		rs.AvgRTTMs = rttSum / float64(rttN)
+	}
+	return rs
+}
+
+// runStats — тикер комнаты: раз в statsPushInterval рассылает участникам {type:"stats"}.
+// каждый получает агрегаты комнаты и только свою статистику: адреса ICE-пар других
+// участников (их публичные ip:port) видят лишь модераторы через REST.
+// завершается, когда комната удалена (закрыт r.done)
+func (r *Room) runStats() {
+	t := time.NewTicker(statsPushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+			rs := r.collectStats(statsPush)
+			for _, ps := range rs.Participants {
+				u := r.GetUser(ps.ID)
+				if u == nil {
+					continue
+				}
+				own := rs
+				own.Participants = []ParticipantStats{ps}
+				_ = u.Send(SignalMessage{Type: TypeStats, Room: r.ID, Stats: &own})
+			}
+		}
+	}
+}
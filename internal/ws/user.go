@@ -2,8 +2,13 @@ package ws
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"voicechat/internal/ice"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -11,21 +16,89 @@ import (
 )
 
 type User struct {
-	ID          string
+	// ID - id участника в комнате: у WebSocket-участника это id пользователя,
+	// у WHIP/WHEP-сессии - свой (см. whip.go), чтобы тот же пользователь мог быть в комнате и из браузера
+	ID string
+	// account - id пользователя в БД (записи, чат, баны, права)
+	account     string
 	DisplayName string
-	Conn        *websocket.Conn        // WebSocket соединение с клиентом; используется для обмена сигнальными сообщениями
-	PC          *webrtc.PeerConnection // PeerConnection этого пользователя; через него проходит весь RTP-трафик (аудио) и происходит SDP-переговоры
-	room        *Room
+	Conn        *websocket.Conn // WebSocket соединение с клиентом; используется для обмена сигнальными сообщениями (nil у WHIP/WHEP)
+	// pc - PeerConnection этого пользователя; через него проходит весь RTP-трафик (аудио) и происходит SDP-переговоры.
+	// атомарный, т.к. читается из горутин других участников (addOutgoingTrack, addSlots, PLI)
+	pc atomic.Pointer[webrtc.PeerConnection]
+	// room - комната участника; RemoveUser обнуляет её из другой горутины, поэтому читатели берут снимок через Load
+	room atomic.Pointer[Room]
+	// kind - как участник подключён: WebSocket или WHIP/WHEP без сигналинга (см. whip.go)
+	kind sessionKind
+	// resource - id WHIP/WHEP-сессии из Location, "" у WebSocket-участников
+	resource string
 
 	// outgoing хранит локальные TrackLocalStaticRTP для каждого источника
 	// у одного источника - несколько треков, в которые он отправяет пакеты
 	// ключ srcID - (id отправителя/источника)
 	// значение - локальный трек получателя, в который приходит звук от отправителя (через сервер)
 	outgoing map[string]*webrtc.TrackLocalStaticRTP
-	outMtx   sync.RWMutex
-
-	// защищает SDP-переговоры от race condition
+	// senders хранит RTPSender'ы, которые вернул PC.AddTrack для каждого источника
+	// нужны, чтобы снять трек с PeerConnection получателя, когда источник уходит из комнаты
+	senders map[string]*webrtc.RTPSender
+	// slots - пул слотов пересылки в режиме last-N (см. lastn.go), вместо outgoing/senders
+	slots []*forwardSlot
+	// mixed - клиент попросил в join сведённый звук вместо отдельных треков (см. mcu.go)
+	mixed bool
+	// mixOut - трек сведения в режиме mixed
+	mixOut *mixedOutput
+	outMtx sync.RWMutex
+
+	// защищает SDP-переговоры от race condition, а также negState, pendingRenegotiation и pendingICERestart
 	negotiationMtx sync.Mutex
+	// negState - состояние SDP-переговоров со стороны сервера (см. negotiation.go)
+	negState negotiationState
+	// pendingRenegotiation - набор треков изменился, пока переговоры были не в stable;
+	// один offer отправится после получения answer и покроет все накопленные изменения
+	pendingRenegotiation bool
+	// pendingICERestart - следующий offer должен перезапустить ICE (после resume, см. resume.go)
+	pendingICERestart bool
+
+	// pendingCandidates - ICE кандидаты клиента, пришедшие до того, как у PeerConnection
+	// появился remote description (или до создания самого PC); добавляются после SetRemoteDescription
+	pendingCandidates []webrtc.ICECandidateInit
+	candMtx           sync.Mutex
+
+	// muted - источник заглушён модератором на сервере: его RTP не пересылается остальным.
+	// копия состояния комнаты (Room.muted), чтобы цикл пересылки не брал блокировку комнаты
+	muted atomic.Bool
+	// vad - детектор речи этого источника по RFC 6464 audio-level (см. vad.go)
+	vad voiceActivity
+	// stats - потери, джиттер и RTT входящего и исходящих RTP-путей (см. rtcp.go)
+	stats pathStatsSet
+	// bitrate - прошлые замеры байт ICE-пары, у рассылки и REST свои (см. stats.go)
+	bitrate [statsConsumers]bitrateSample
+	// chat - канал текстового чата (см. chat.go); появляется вместе с PeerConnection
+	chat atomic.Pointer[webrtc.DataChannel]
+
+	// session - токен возобновления сессии после обрыва WebSocket (см. resume.go), "" у WHIP/WHEP
+	session string
+	// connMtx защищает Conn при обрыве и возобновлении: connDone, connGen, detached, graceTimer
+	connMtx sync.Mutex
+	// connDone закрывается, когда текущий Conn отвязан или заменён; останавливает его WritePump
+	connDone chan struct{}
+	// connGen - номер текущего соединения, растёт при каждом resume
+	connGen uint64
+	// createdAt - время входа; reaper закрывает тех, кто не соединился за connectTimeout (см. keepalive.go)
+	createdAt time.Time
+	// connected - PeerConnection хотя бы раз был в состоянии connected
+	connected atomic.Bool
+	// iceTimer - ожидание восстановления PeerConnection из disconnected, защищён iceMtx
+	iceTimer *time.Timer
+	iceMtx   sync.Mutex
+	// detached - WebSocket оборван, пользователь ждёт resume в течение resumeGrace
+	detached   bool
+	graceTimer *time.Timer
+
+	// send - исходящая очередь сигнальных сообщений, её вычитывает только WritePump
+	send chan SignalMessage
+	// done закрывается в Close и останавливает WritePump
+	done chan struct{}
 
 	// закрытие выполняется только один раз
 	closeOnce sync.Once
@@ -36,120 +109,195 @@ type User struct {
 // после join handler перезаписывает u.ID значением из токена
 func NewUser(conn *websocket.Conn, room *Room) *User {
 	u := &User{
-		ID:       uuid.New().String(),
-		Conn:     conn,
-		outgoing: make(map[string]*webrtc.TrackLocalStaticRTP),
+		ID:        uuid.New().String(),
+		Conn:      conn,
+		outgoing:  make(map[string]*webrtc.TrackLocalStaticRTP),
+		senders:   make(map[string]*webrtc.RTPSender),
+		connDone:  make(chan struct{}),
+		createdAt: time.Now(),
+		send:      make(chan SignalMessage, sendQueueSize),
+		done:      make(chan struct{}),
 	}
 	return u
 }
 
-// ReadPump слушает сообщения по WebSocket и обрабатывает сигнальные команды:
+// ReadPump слушает сообщения по WebSocket conn и обрабатывает сигнальные команды:
 // - join (offer) — клиент отправил offer при первом join
 // - candidate — ICE кандидат от клиента
+// - offer — renegotiation со стороны клиента
 // - answer — ответ клиента на offer сервера
+// - mute / unmute / kick / ban — команды модератора (см. moderation.go)
+// - startRecording / stopRecording — запись комнаты (см. recorder.go)
 // - leave — закрыть соединение
-func (u *User) ReadPump() {
-	defer u.Close()
-
+// обрыв соединения не закрывает пользователя сразу: он ждёт resume (см. resume.go).
+// клиент, не приславший за pongWait ни сообщения, ни pong, считается оборвавшимся (см. keepalive.go)
+func (u *User) ReadPump(conn *websocket.Conn) {
+	watchPongs(conn)
 	for {
 		// чтение сообщения WebSocket
-		_, raw, err := u.Conn.ReadMessage()
+		_, raw, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("ws read:", err)
+			if isTimeout(err) {
+				deadPeersTotal.WithLabelValues("pong_timeout").Inc()
+			}
+			u.detach(conn)
 			return
 		}
+		armReadDeadline(conn)
 		var msg SignalMessage
 		if err := json.Unmarshal(raw, &msg); err != nil {
 			log.Println("invalid signal json:", err)
+			u.reply(msg, &ProtocolError{Code: CodeBadRequest, Message: "invalid JSON"})
 			continue
 		}
 		switch msg.Type {
-		case "join":
+		case TypeJoin:
 			// объединяем join + offer, потому что при первом подключении клиент сразу присылает offer
 			// и сервер должен ответить answer. Если SDP есть и это offer, обрабатываем его.
 			if msg.SDP != "" && msg.SDPType == "offer" {
 				if err := u.ReceiveOfferAndAnswerBack(msg.SDP); err != nil {
 					log.Println("error answering join offer:", err)
+					u.reply(msg, offerError(err))
+					// при glare сессия жива: клиент ответит на offer сервера
+					if errors.Is(err, errGlare) {
+						continue
+					}
+					u.Close()
 					return
 				}
 			}
-		case "candidate":
+			u.reply(msg, nil)
+		case TypeCandidate:
 			// ICE кандидаты от клиента приходят отдельными сообщениями
 			var cand webrtc.ICECandidateInit
-			if len(msg.Candidate) > 0 {
-				if err := json.Unmarshal(msg.Candidate, &cand); err == nil {
-					// проверяем, что PeerConnection уже создан
-					if u.PC != nil {
-						// добавляем кандидата в PeerConnection
-						// после добавления ICE-агент будет пробовать установить соединение с этим кандидатом
-						if err := u.PC.AddICECandidate(cand); err != nil {
-							log.Println("AddICECandidate error:", err)
-						}
-					}
-				}
+			if err := json.Unmarshal(msg.Candidate, &cand); err != nil {
+				u.reply(msg, &ProtocolError{Code: CodeInvalidMessage, Message: "invalid candidate"})
+				continue
 			}
-		case "answer":
-			if msg.SDP != "" && msg.SDPType == "answer" {
-				// если PeerConnection ещё не создан — ничего не делаем, логируем
-				if u.PC == nil {
-					log.Println("received answer but PC is nil")
-					continue
-				}
-
-				// создаём объект SessionDescription с типом Answer
-				// это SDP, которое клиент сформировал в ответ на наш offer
-				sdp := webrtc.SessionDescription{
-					Type: webrtc.SDPTypeAnswer,
-					SDP:  msg.SDP,
-				}
-
-				// устанавливаем это описание как remote description в PeerConnection
-				// после этого WebRTC знает, какие кодеки, форматы, ICE кандидаты использует клиент
-				// теперь наш PeerConnection может начать отправлять и получать RTP/RTCP потоки
-				if err := u.PC.SetRemoteDescription(sdp); err != nil {
-					log.Println("SetRemoteDescription answer:", err)
-				}
+			u.addRemoteCandidate(cand)
+			u.reply(msg, nil)
+		case TypeOffer:
+			// renegotiation, инициированная клиентом (например, он добавил/убрал микрофон)
+			if msg.SDP == "" || msg.SDPType != "offer" {
+				u.reply(msg, &ProtocolError{Code: CodeInvalidMessage, Message: "offer requires sdp"})
+				continue
+			}
+			if err := u.ReceiveOfferAndAnswerBack(msg.SDP); err != nil {
+				log.Println("error answering offer:", err)
+				u.reply(msg, offerError(err))
+				continue
+			}
+			u.reply(msg, nil)
+		case TypeAnswer:
+			if msg.SDP == "" || msg.SDPType != "answer" {
+				u.reply(msg, &ProtocolError{Code: CodeInvalidMessage, Message: "answer requires sdp"})
+				continue
 			}
-		case "leave":
+			err := u.handleAnswer(msg.SDP)
+			u.reply(msg, err)
+			// answer не применился — PeerConnection непригоден (см. handleAnswer);
+			// ошибка дойдёт до клиента: WritePump дописывает очередь перед закрытием сокета
+			var pe *ProtocolError
+			if errors.As(err, &pe) && pe.Code == CodeNegotiationFailed {
+				u.Close()
+				return
+			}
+		case TypeMute, TypeUnmute, TypeKick, TypeBan:
+			// команды модератора, цель — msg.To (id участника этой же комнаты)
+			u.reply(msg, u.handleModeration(msg))
+		case TypeStartRecording, TypeStopRecording:
+			// запись комнаты, только модераторы (см. recorder.go)
+			u.reply(msg, u.handleRecording(msg))
+		case TypeLeave:
+			// ack дойдёт до клиента: WritePump дописывает очередь перед закрытием сокета
+			u.reply(msg, nil)
+			u.Close()
 			return
 		default:
 			log.Println("unknown msg type:", msg.Type)
+			u.reply(msg, &ProtocolError{Code: CodeUnknownType, Message: "unknown message type " + msg.Type})
 		}
 	}
 }
 
-// ReceiveOfferAndAnswerBack создаёт PeerConnection, привязывает обработчики
-// ICE кандидатов и OnTrack. Затем устанавливает remote offer, создаёт answer
-// и отсылает его клиенту. Также OnTrack реплицирует потоки другим участникам.
+// ReceiveOfferAndAnswerBack принимает offer клиента и отсылает ему answer.
+// при первом offer создаёт PeerConnection (newPeerConnection), последующие offer
+// обрабатываются как renegotiation на том же PeerConnection с учётом glare (см. answerOffer).
 func (u *User) ReceiveOfferAndAnswerBack(offerSDP string) error {
+	first := u.pc.Load() == nil
+	if first {
+		pc, err := u.newPeerConnection()
+		if err != nil {
+			return err
+		}
+		u.pc.Store(pc)
+	}
+
+	if err := u.answerOffer(offerSDP); err != nil {
+		// glare — штатный исход perfect negotiation, не сбой
+		if !errors.Is(err, errGlare) {
+			negotiationFailuresTotal.WithLabelValues("answer").Inc()
+		}
+		return err
+	}
+
+	// PeerConnection готов — подписываем пользователя на тех, кто уже говорит в комнате
+	if room := u.room.Load(); first && room != nil {
+		room.SubscribeToExisting(u)
+	}
+	return nil
+}
+
+// newPeerConnection создаёт PeerConnection пользователя и привязывает обработчики
+// ICE кандидатов и OnTrack. OnTrack реплицирует потоки другим участникам.
+func (u *User) newPeerConnection() (*webrtc.PeerConnection, error) {
 	// конфигурация PeerConnection: указываем ICE-серверы (STUN/TURN) для определения публичных адресов
 	// и прохождения NAT, чтобы WebRTC мог установить соединение между клиентом и сервером.
+	// список серверов задаётся при старте через переменные окружения (см. ice.Init)
 	cfg := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+		ICEServers: ice.ServerICEServers(),
 	}
 
-	pc, err := webrtc.NewPeerConnection(cfg)
+	// PeerConnection создаётся через общий api: единый ICE порт, NAT 1:1 и т.д. (см. api.go)
+	pc, err := api.NewPeerConnection(cfg)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// канал текстового чата согласован заранее, создаём его до первого SetRemoteDescription
+	if err := u.openChat(pc); err != nil {
+		_ = pc.Close()
+		return nil, err
 	}
-	u.PC = pc
+
+	// failed и затянувшийся disconnected закрывают участника (см. keepalive.go)
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		u.onConnectionStateChange(pc, s)
+	})
 
 	// OnICECandidate — вызывается каждый раз, когда серверный PeerConnection находит новый ICE-кандидат.
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		// без trickle ICE кандидаты уходят клиенту внутри SDP, отдельно их не шлём
+		if !trickleICE {
+			return
+		}
+		// nil означает, что ICE gathering завершён — сообщаем клиенту, что кандидатов больше не будет
 		if c == nil {
+			_ = u.Send(SignalMessage{Type: TypeEndOfCandidates})
 			return
 		}
 		// преобразуем ICE-кандидата в JSON для передачи по сигналингу
 		cj := c.ToJSON()
 		log.Printf("server ICE candidate: %+v\n", cj)
 		// формируем сигналинговое сообщение для клиента
-		m := SignalMessage{Type: "candidateFromServer"}
+		m := SignalMessage{Type: TypeCandidateFromServer}
 		// сериализуем ICE-кандидата в слайс байт для отправки клиенту
 		raw, _ := json.Marshal(cj)
 		m.Candidate = raw
 		// отправляем ICE-кандидата клиенту по WebSocket
 		// клиент добавит его в свой PeerConnection через AddICECandidate
-		_ = u.Conn.WriteJSON(m)
+		_ = u.Send(m)
 	})
 
 	// когда приходит трек от этого пользователя — реплицируем его другим
@@ -163,41 +311,65 @@ func (u *User) ReceiveOfferAndAnswerBack(offerSDP string) error {
 		srcID := u.ID
 		// логируем получение трека от конкретного пользователя
 		log.Printf("OnTrack: got track from %s codec=%s\n", srcID, remoteTrack.Codec().MimeType)
+		// чат голосовой: видео (например, из OBS по WHIP) не пересылаем
+		if remoteTrack.Kind() != webrtc.RTPCodecTypeAudio {
+			log.Printf("OnTrack: ignoring %s track from %s\n", remoteTrack.Kind(), srcID)
+			return
+		}
+
+		// комнату читаем один раз: RemoveUser может обнулить u.room в любой момент
+		if room := u.room.Load(); room != nil {
+			// регистрируем трек в реестре комнаты, чтобы те, кто зайдёт позже, тоже получили этот источник
+			room.AddTrack(srcID, remoteTrack)
+			defer room.RemoveTrack(srcID, remoteTrack)
+			if room.lastN > 0 && !slottable(remoteTrack.Codec()) {
+				log.Printf("OnTrack: %s codec %s does not fit last-N slots, not forwarded\n", srcID, remoteTrack.Codec().MimeType)
+			}
+
+			// если в комнате идёт запись — начинаем файл и для этого источника
+			if rec := room.activeRecorder(); rec != nil && recordable(remoteTrack.Codec()) {
+				rec.open(srcID, u.account)
+			}
+			defer func() {
+				if rec := room.activeRecorder(); rec != nil {
+					rec.closeSource(srcID)
+				}
+				// трек закончился — источник больше не звучит в сведении
+				if mix := room.activeMix(); mix != nil {
+					mix.mixer.Remove(srcID)
+				}
+			}()
 
-		if u.room != nil {
 			// проходим по всем пользователям в комнате
-			u.room.IterateUsers(func(other *User) {
-				// не реплицируем трек обратно отправителю
-				if other.ID == srcID {
+			// (в режиме last-N треки не добавляются: источник попадёт в слоты получателей по активности;
+			// получатели в режиме mixed слышат его в сведении)
+			room.IterateUsers(func(other *User) {
+				if room.lastN > 0 || !other.listensToSources() {
 					return
 				}
-				// если PeerConnection получателя ещё не готов - скип
-				if other.PC == nil {
-					log.Printf("skip adding track for user %s: PC not ready\n", other.ID)
+				// не реплицируем трек обратно отправителю
+				if other.ID == srcID {
 					return
 				}
-				// получаем параметры кодека удаленного трека, который прислал отправитель
-				cap := remoteTrack.Codec().RTPCodecCapability
-				// создаём локальный трек для получателя, чтобы сервер мог писать в него RTP пакеты
-				localTrack, err := webrtc.NewTrackLocalStaticRTP(cap, "audio", srcID)
-				if err != nil {
-					log.Println("create track local:", err)
+				// создаём локальный трек для получателя и добавляем его в PeerConnection
+				if !other.addOutgoingTrack(srcID, remoteTrack.Codec().RTPCodecCapability) {
 					return
 				}
-				// записываем в мапу лок.трек получателя для конкретного отправителя (srcID)
-				other.outMtx.Lock()
-				other.outgoing[srcID] = localTrack
-				other.outMtx.Unlock()
-
-				// добавляем трек в PeerConnection получателя
-				if _, err := other.PC.AddTrack(localTrack); err != nil {
-					log.Println("other.PC.AddTrack error:", err)
-				}
 				// в горутине инициируем повторную SDP re-negotiation с other, сервер создаёт offer, отправляет по WS, ждёт answer
 				go other.Negotiate()
 			})
 		}
 
+		// RTCP от клиента по этому треку вычитываем отдельно, иначе интерсепторы копят буфер
+		go readReceiverRTCP(receiver)
+
+		// id расширения audio-level, согласованный с этим клиентом (0 — клиент его не шлёт)
+		levelExtID := audioLevelExtID(receiver)
+		defer u.vad.reset()
+		clockRate := remoteTrack.Codec().ClockRate
+		// в сведение попадает только Opus — его умеет декодировать микшер
+		mixable := recordable(remoteTrack.Codec())
+
 		for {
 			// читаем RTP пакет с удалённого трека отправителя
 			pkt, _, err := remoteTrack.ReadRTP()
@@ -205,128 +377,181 @@ func (u *User) ReceiveOfferAndAnswerBack(offerSDP string) error {
 				log.Println("remoteTrack.ReadRTP:", err)
 				return
 			}
-			// пересылаем пакет всем остальным участникам комнаты
-			if u.room != nil {
-				u.room.IterateUsers(func(dest *User) {
-					// кроме отправителя
-					if dest.ID == srcID {
-						return
-					}
-
-					// берем локальный трек получателя
-					dest.outMtx.RLock()
-					tr := dest.outgoing[srcID]
-					dest.outMtx.RUnlock()
-
-					// если смогли взять трек, пишем в него rtp-пакеты
-					if tr != nil {
-						if writeErr := tr.WriteRTP(pkt); writeErr != nil {
-							log.Println("WriteRTP error:", writeErr)
-						}
-					}
-				})
+			now := time.Now()
+			// потери и джиттер входящего пути считаем по всем пакетам, в том числе заглушённым
+			u.observeInbound(pkt, clockRate, now)
+			// источник заглушён модератором — пакеты читаем (чтобы не копились в буферах), но не пересылаем
+			if u.muted.Load() {
+				u.vad.reset()
+				rtpPacketsDropped.WithLabelValues("muted").Inc()
+				continue
 			}
+			// уровень громкости из RTP header extension — для speaking/activeSpeaker
+			u.vad.observe(pkt, levelExtID, now)
+			// участник мог уйти из комнаты — тогда пакет никуда не идёт
+			room := u.room.Load()
+			if room == nil {
+				continue
+			}
+			// если комната записывается — пишем пакет в файл источника
+			if rec := room.activeRecorder(); rec != nil {
+				rec.write(srcID, pkt)
+			}
+			// есть получатели в режиме mixed — отдаём пакет в сведение
+			if mix := room.activeMix(); mix != nil && mixable {
+				mix.mixer.Push(srcID, pkt)
+			}
+			// пересылаем пакет всем остальным участникам комнаты
+			room.IterateUsers(func(dest *User) {
+				// кроме отправителя, получателей сведения и WHIP-участников
+				if dest.ID == srcID || !dest.listensToSources() {
+					return
+				}
+				// в локальный трек или слот получателя (см. forward)
+				dest.forward(srcID, pkt)
+			})
 		}
 	})
 
-	// преобразуем offer клиента в SessionDescription и ставим как remote description
-	offer := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer,
-		SDP:  offerSDP, // SDP клиента с его кодеками, треками и ICE
-
-	}
-
-	// устанавливаем remote description на серверной PeerConnection чтобы, PC знал треки, кодеки и ICE-кандидаты
-	if err := pc.SetRemoteDescription(offer); err != nil {
-		return err
-	}
+	return pc, nil
+}
 
-	// создаём ответ сервера (answer) и ставим как локальное описание
-	// теперь сервер знает, какие треки/кодеки/ICE он предлагает клиенту
-	answer, err := pc.CreateAnswer(nil)
-	if err != nil {
-		return err
+// addRemoteCandidate добавляет ICE кандидата клиента в PeerConnection.
+// если PC ещё не создан или у него нет remote description (AddICECandidate в этом случае
+// вернёт ошибку), кандидат откладывается в очередь и будет добавлен в flushPendingCandidates
+func (u *User) addRemoteCandidate(cand webrtc.ICECandidateInit) {
+	u.candMtx.Lock()
+	pc := u.pc.Load()
+	if pc == nil || pc.RemoteDescription() == nil {
+		u.pendingCandidates = append(u.pendingCandidates, cand)
+		u.candMtx.Unlock()
+		return
 	}
+	u.candMtx.Unlock()
 
-	// устанавливаем локальное описание на сервере — answer
-	// теперь сервер знает, какие треки/кодеки/ICE он предлагает клиенту
-	if err := pc.SetLocalDescription(answer); err != nil {
-		return err
+	// добавляем кандидата в PeerConnection
+	// после добавления ICE-агент будет пробовать установить соединение с этим кандидатом
+	if err := pc.AddICECandidate(cand); err != nil {
+		log.Println("AddICECandidate error:", err)
 	}
+}
 
-	// ждём, пока ICE-агент соберёт все локальные кандидаты для PeerConnection
-	gatherComplete := webrtc.GatheringCompletePromise(pc)
-	<-gatherComplete
+// flushPendingCandidates добавляет в PeerConnection кандидатов, накопленных до SetRemoteDescription
+func (u *User) flushPendingCandidates() {
+	u.candMtx.Lock()
+	pending := u.pendingCandidates
+	u.pendingCandidates = nil
+	u.candMtx.Unlock()
 
-	/// берем локальное описание (answer + локальные ICE кандидаты) для отправки клиенту через WebSocket
-	local := pc.LocalDescription()
-	resp := SignalMessage{
-		Type:    "answer",
-		SDP:     local.SDP,
-		SDPType: local.Type.String(),
-	}
-	// отправляем клиенту answer через WebSocket
-	// после этого клиент сможет установить remote description и начать передачу аудио
-	if err := u.Conn.WriteJSON(resp); err != nil {
-		return err
+	for _, cand := range pending {
+		if err := u.pc.Load().AddICECandidate(cand); err != nil {
+			log.Println("AddICECandidate (queued) error:", err)
+		}
 	}
-	return nil
 }
 
-// Negotiate запускает SDP-переговоры с клиентом.
-// вызывается, когда на серверной PeerConnection меняется набор треков (добавили, удалили итд)
-func (u *User) Negotiate() {
-	if u.PC == nil {
-		return
+// addOutgoingTrack создаёт локальный трек (TrackLocalStaticRTP) для пересылки этому пользователю
+// аудио источника srcID и добавляет его в PeerConnection получателя.
+// возвращает true, если трек был добавлен и нужна renegotiation; false — если PC ещё не готов
+// или трек для этого источника уже существует (защита от двойного добавления при гонке OnTrack и join)
+func (u *User) addOutgoingTrack(srcID string, cap webrtc.RTPCodecCapability) bool {
+	// если PeerConnection получателя ещё не готов - скип
+	pc := u.pc.Load()
+	if pc == nil {
+		log.Printf("skip adding track for user %s: PC not ready\n", u.ID)
+		return false
 	}
-	u.negotiationMtx.Lock()
-	defer u.negotiationMtx.Unlock()
 
-	// создаём SDP offer — описание текущего состояния PeerConnection:
-	// какие треки, кодеки и направления передачи сервер предлагает клиенту
-	offer, err := u.PC.CreateOffer(nil)
+	u.outMtx.Lock()
+	if _, exists := u.outgoing[srcID]; exists {
+		u.outMtx.Unlock()
+		return false
+	}
+	// создаём локальный трек для получателя, чтобы сервер мог писать в него RTP пакеты
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(cap, "audio", srcID)
 	if err != nil {
-		log.Println("CreateOffer:", err)
-		return
+		u.outMtx.Unlock()
+		log.Println("create track local:", err)
+		return false
 	}
+	// записываем в мапу лок.трек получателя для конкретного отправителя (srcID)
+	u.outgoing[srcID] = localTrack
+	u.outMtx.Unlock()
 
-	// устанавливаем offer как LocalDescription.
-	// этим мы фиксируем состояние PeerConnection и запускаем ICE-gathering
-	if err := u.PC.SetLocalDescription(offer); err != nil {
-		log.Println("SetLocalDescription:", err)
-		return
+	// добавляем трек в PeerConnection получателя
+	sender, err := pc.AddTrack(localTrack)
+	if err != nil {
+		log.Println("PC.AddTrack error:", err)
+		u.outMtx.Lock()
+		delete(u.outgoing, srcID)
+		u.outMtx.Unlock()
+		return false
 	}
+	u.outMtx.Lock()
+	u.senders[srcID] = sender
+	u.outMtx.Unlock()
+	// receiver report'ы клиента по этому треку — в статистику, заодно не даём копиться буферу интерсепторов
+	go u.readSenderRTCP(srcID, sender, cap.ClockRate, func() string { return srcID })
+	return true
+}
 
-	// ожидаем завершения ICE gathering,
-	// чтобы LocalDescription содержал собранные ICE-кандидаты
-	gatherComplete := webrtc.GatheringCompletePromise(u.PC)
-	<-gatherComplete
-	local := u.PC.LocalDescription()
-
-	// отправляем offer клиенту через signaling (WebSocket)
-	msg := SignalMessage{
-		Type:    "offer",
-		SDP:     local.SDP,
-		SDPType: local.Type.String(),
+// removeOutgoingTrack снимает с PeerConnection получателя трек источника srcID
+// и удаляет его из outgoing/senders.
+// возвращает true, если трек был и нужна renegotiation
+func (u *User) removeOutgoingTrack(srcID string) bool {
+	u.outMtx.Lock()
+	_, hadTrack := u.outgoing[srcID]
+	sender := u.senders[srcID]
+	delete(u.outgoing, srcID)
+	delete(u.senders, srcID)
+	u.outMtx.Unlock()
+
+	if !hadTrack {
+		return false
 	}
-	if err := u.Conn.WriteJSON(msg); err != nil {
-		log.Println("send offer:", err)
+	// RemoveTrack переводит транссивер в inactive — после renegotiation клиент получит событие об удалении трека
+	pc := u.pc.Load()
+	if sender != nil && pc != nil {
+		if err := pc.RemoveTrack(sender); err != nil {
+			log.Println("PC.RemoveTrack error:", err)
+		}
 	}
+	return true
+}
+
+// listensToSources сообщает, получает ли участник источники по отдельности (треки или слоты last-N).
+// получатели сведения слышат комнату через mcu.go, WHIP-участники не слышат ничего
+func (u *User) listensToSources() bool {
+	return !u.mixed && u.kind != sessionWHIP
+}
+
+// participant возвращает описание пользователя для roster и REST API
+func (u *User) participant() Participant {
+	return Participant{ID: u.ID, DisplayName: u.DisplayName, Muted: u.muted.Load()}
 }
 
 // Close аккуратно закрывает ресурсы: удаляет пользователя из комнаты,
-// закрывает PeerConnection и WebSocket. Выполняется один раз (closeOnce).
+// закрывает PeerConnection и останавливает WritePump. Выполняется один раз (closeOnce).
+// сам WebSocket закрывает WritePump — после того как допишет уже поставленные в очередь
+// сообщения (например, kicked), чтобы клиент узнал причину отключения.
 func (u *User) Close() {
 	u.closeOnce.Do(func() {
 		log.Println("closing user", u.ID)
-		if u.room != nil {
-			u.room.RemoveUser(u)
+		// останавливаем WritePump и запрещаем новые Send
+		close(u.done)
+		u.connMtx.Lock()
+		if u.graceTimer != nil {
+			u.graceTimer.Stop()
 		}
-		if u.PC != nil {
-			_ = u.PC.Close()
+		u.connMtx.Unlock()
+		forgetSession(u)
+		u.stopICETimer()
+		if room := u.room.Load(); room != nil {
+			room.RemoveUser(u)
 		}
-		if u.Conn != nil {
-			_ = u.Conn.Close()
+		if pc := u.pc.Load(); pc != nil {
+			_ = pc.Close()
 		}
+		forgetHTTPSession(u)
 	})
 }
@@ -0,0 +1,153 @@
+package ws
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// audioLevelURI — RTP header extension RFC 6464 (уровень громкости в каждом аудиопакете)
+const audioLevelURI = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+
+// audioLevelExtID возвращает id расширения audio-level, согласованный в SDP для этого receiver'а,
+// или 0, если клиент его не поддерживает
+func audioLevelExtID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == audioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// voiceActivity — детектор речи одного источника по уровням из RTP.
+// громкость хранится как 127 - level (0 — тишина, 127 — максимум) и сглаживается EWMA.
+// обновляется из цикла пересылки RTP (observe), а решения speaking принимает тикер комнаты (evaluate).
+type voiceActivity struct {
+	mtx       sync.Mutex
+	loudness  float64   // сглаженная громкость
+	lastVoice time.Time // когда сглаженная громкость последний раз была выше порога
+	speaking  bool      // последнее разосланное состояние
+}
+
+// observe учитывает уровень из очередного RTP-пакета
+func (v *voiceActivity) observe(pkt *rtp.Packet, extID uint8, now time.Time) {
+	if extID == 0 {
+		return
+	}
+	raw := pkt.GetExtension(extID)
+	if raw == nil {
+		return
+	}
+	var ext rtp.AudioLevelExtension
+	if err := ext.Unmarshal(raw); err != nil {
+		return
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.loudness = vadSmoothing*float64(127-ext.Level) + (1-vadSmoothing)*v.loudness
+	if v.loudness >= float64(127-vadThreshold) {
+		v.lastVoice = now
+	}
+}
+
+// speakerState — снимок детектора речи источника на момент пересчёта
+type speakerState struct {
+	loudness  float64
+	lastVoice time.Time
+	speaking  bool
+}
+
+// evaluate пересчитывает состояние speaking с учётом vadHold.
+// возвращает снимок состояния и признак того, что speaking изменился
+func (v *voiceActivity) evaluate(now time.Time) (speakerState, bool) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	speaking := !v.lastVoice.IsZero() && now.Sub(v.lastVoice) < vadHold
+	changed := speaking != v.speaking
+	v.speaking = speaking
+	return speakerState{loudness: v.loudness, lastVoice: v.lastVoice, speaking: speaking}, changed
+}
+
+// reset сбрасывает детектор (источник заглушён или его трек закончился)
+func (v *voiceActivity) reset() {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.loudness = 0
+	v.lastVoice = time.Time{}
+}
+
+// runVAD — тикер комнаты: раз в vadInterval пересчитывает, кто говорит,
+// рассылает speaking при смене состояния источника и activeSpeaker при смене самого громкого,
+// а в режиме last-N перераскладывает источники по слотам получателей.
+// завершается, когда комната удалена (закрыт r.done).
+func (r *Room) runVAD() {
+	t := time.NewTicker(vadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-t.C:
+			r.evaluateSpeakers(now)
+		}
+	}
+}
+
+// evaluateSpeakers — один шаг runVAD
+func (r *Room) evaluateSpeakers(now time.Time) {
+	var (
+		events  []SignalMessage
+		loudest string
+		maxLoud float64
+	)
+	// источники с активным треком в кодеке слотов — кандидаты в слоты last-N
+	r.mtx.RLock()
+	active := make(map[string]bool, len(r.tracks))
+	for id, t := range r.tracks {
+		active[id] = slottable(t.Codec())
+	}
+	r.mtx.RUnlock()
+	states := make(map[string]speakerState, len(active))
+
+	r.IterateUsers(func(u *User) {
+		st, changed := u.vad.evaluate(now)
+		if changed {
+			s := st.speaking
+			events = append(events, SignalMessage{Type: TypeSpeaking, From: u.ID, Speaking: &s})
+		}
+		if st.speaking && st.loudness > maxLoud {
+			loudest, maxLoud = u.ID, st.loudness
+		}
+		if active[u.ID] && !u.muted.Load() {
+			states[u.ID] = st
+		}
+	})
+
+	if r.lastN > 0 {
+		ranked := rankSources(states)
+		r.IterateUsers(func(u *User) {
+			u.assignSlots(ranked)
+		})
+	}
+
+	// активный спикер меняется только на другого говорящего: в паузах остаётся последний
+	r.mtx.Lock()
+	if loudest != "" && loudest != r.activeSpeaker {
+		r.activeSpeaker = loudest
+		events = append(events, SignalMessage{Type: TypeActiveSpeaker, From: loudest})
+	}
+	r.mtx.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+	r.IterateUsers(func(u *User) {
+		for _, e := range events {
+			_ = u.Send(e)
+		}
+	})
+}
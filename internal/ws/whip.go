@@ -0,0 +1,260 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"voicechat/internal/mixer"
+	"voicechat/internal/store"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// WHIP (RFC 9725) и WHEP — подключение к комнате обычным HTTP offer/answer, без сигналинга
+// по WebSocket: OBS/GStreamer публикуют звук в комнату (WHIP), плееры слушают её (WHEP).
+// участник такой сессии — обычный User комнаты без WebSocket: его трек пересылается
+// остальным тем же OnTrack, что и у браузеров. renegotiation в WHIP/WHEP нет, поэтому:
+//   - WHIP-участник только отправляет звук и сам ничего не получает;
+//   - WHEP-участник получает один трек сведения комнаты (режим mixed, см. mcu.go) —
+//     набор источников меняется, а его трек нет.
+//
+// у сессии свой id участника — id пользователя с суффиксом "/whip" или "/whep" (sessionID),
+// поэтому пользователь, публикующий звук из OBS, может и слушать комнату из браузера,
+// а повторная WHIP-сессия того же пользователя отклоняется как already_joined.
+//
+// HTTP-часть (Bearer-токен, коды ответов, Location) — в cmd/server/whip.go.
+
+// sessionKind — как участник подключён к комнате
+type sessionKind int
+
+const (
+	// sessionWS — браузер с сигналингом по WebSocket
+	sessionWS sessionKind = iota
+	// sessionWHIP — публикация звука по WHIP, участник ничего не получает
+	sessionWHIP
+	// sessionWHEP — прослушивание сведения комнаты по WHEP, участник ничего не отправляет
+	sessionWHEP
+)
+
+var (
+	// ErrUnknownUser — пользователя из токена нет в БД
+	ErrUnknownUser = errors.New("user not found")
+	// ErrSessionNotFound — WHIP/WHEP-сессии с таким id нет (или она чужая)
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrAlreadyJoined — пользователь уже в комнате (по WebSocket или другой сессией)
+	ErrAlreadyJoined = errors.New("user already in room")
+	// ErrICERestartUnsupported — PATCH с новыми ice-ufrag/ice-pwd: ICE restart в WHIP/WHEP не поддерживается
+	ErrICERestartUnsupported = errors.New("ice restart not supported")
+	// ErrInvalidOffer — offer не удалось применить
+	ErrInvalidOffer = errors.New("invalid offer")
+	// ErrMixUnavailable — WHEP на сервере, собранном без Opus: сведения нет
+	ErrMixUnavailable = errors.New("mixing not available")
+)
+
+var (
+	// httpSessions — активные WHIP/WHEP-сессии, ключ — id ресурса из Location
+	httpSessions    = make(map[string]*User)
+	httpSessionsMtx sync.Mutex
+)
+
+// StartWHIP подключает пользователя userID к комнате roomID как источник звука:
+// применяет offer клиента и возвращает id сессии и answer со всеми ICE-кандидатами сервера
+func StartWHIP(ctx context.Context, roomID, userID, offerSDP string) (id, answerSDP string, err error) {
+	return startHTTPSession(ctx, sessionWHIP, roomID, userID, offerSDP)
+}
+
+// StartWHEP подключает пользователя userID к комнате roomID как слушателя сведения комнаты
+func StartWHEP(ctx context.Context, roomID, userID, offerSDP string) (id, answerSDP string, err error) {
+	return startHTTPSession(ctx, sessionWHEP, roomID, userID, offerSDP)
+}
+
+// startHTTPSession — общая часть WHIP и WHEP: те же проверки входа, что и у join по WebSocket
+func startHTTPSession(ctx context.Context, kind sessionKind, roomID, userID, offerSDP string) (string, string, error) {
+	if kind == sessionWHEP && !mixer.Available {
+		return "", "", ErrMixUnavailable
+	}
+	prof, err := store.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", "", err
+	}
+	if prof == nil {
+		joinRejectionsTotal.WithLabelValues(CodeUnauthorized).Inc()
+		return "", "", ErrUnknownUser
+	}
+	// пароль комнаты в WHIP/WHEP не передаётся: защищённые паролем комнаты доступны только участникам
+	settings, perr := authorizeJoin(ctx, roomID, userID, "")
+	if perr != nil {
+		joinRejectionsTotal.WithLabelValues(perr.Code).Inc()
+		return "", "", perr
+	}
+
+	u := NewUser(nil, nil)
+	u.ID = sessionID(userID, kind)
+	u.account = userID
+	u.DisplayName = prof.DisplayName
+	u.kind = kind
+	// WHEP-слушателю, как и клиенту в режиме mixed, уходит одно сведение
+	u.mixed = kind == sessionWHEP
+	u.resource = uuid.New().String()
+	if err := joinRoom(u, roomID, settings.LastN); err != nil {
+		joinRejectionsTotal.WithLabelValues(CodeAlreadyJoined).Inc()
+		return "", "", err
+	}
+	joinsTotal.Inc()
+
+	answer, err := u.answerHTTPOffer(offerSDP)
+	if err != nil {
+		log.Printf("%s session for user %s in room %s: %v\n", kind, userID, roomID, err)
+		negotiationFailuresTotal.WithLabelValues("answer").Inc()
+		u.Close()
+		return "", "", ErrInvalidOffer
+	}
+
+	httpSessionsMtx.Lock()
+	select {
+	case <-u.done:
+		// участника успели отключить (kick, удаление комнаты) — сессии уже нет
+		httpSessionsMtx.Unlock()
+		return "", "", ErrSessionNotFound
+	default:
+		httpSessions[u.resource] = u
+	}
+	httpSessionsMtx.Unlock()
+	log.Printf("✅ %s: user \"%s\" (id=%s) joined room %s, session %s\n", kind, u.DisplayName, userID, roomID, u.resource)
+	return u.resource, answer, nil
+}
+
+// answerHTTPOffer создаёт PeerConnection сессии и отвечает на offer клиента.
+// answer ждёт окончания ICE gathering: досылать кандидаты сервера в WHIP/WHEP некуда
+func (u *User) answerHTTPOffer(offerSDP string) (string, error) {
+	pc, err := u.newPeerConnection()
+	if err != nil {
+		return "", err
+	}
+	u.pc.Store(pc)
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}); err != nil {
+		return "", err
+	}
+	if u.kind == sessionWHEP {
+		// трек сведения займёт recvonly-транссивер из offer клиента
+		if !u.addMixTrack() {
+			return "", errors.New("add mix track failed")
+		}
+		if room := u.room.Load(); room != nil {
+			room.attachMix(u)
+		}
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	awaitGathering(gathered)
+	return pc.LocalDescription().SDP, nil
+}
+
+// TrickleSession добавляет ICE-кандидатов клиента из PATCH (application/trickle-ice-sdpfrag).
+// фрагмент с другими ice-ufrag/ice-pwd означает ICE restart — он не поддерживается
+func TrickleSession(id, userID, frag string) error {
+	u := lookupHTTPSession(id, userID)
+	if u == nil {
+		return ErrSessionNotFound
+	}
+	pc := u.pc.Load()
+	if ufrag := sdpAttr(frag, "ice-ufrag"); ufrag != "" && pc.RemoteDescription() != nil &&
+		ufrag != sdpAttr(pc.RemoteDescription().SDP, "ice-ufrag") {
+		return ErrICERestartUnsupported
+	}
+
+	var mid string
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			cand := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				m := mid
+				cand.SDPMid = &m
+			}
+			u.addRemoteCandidate(cand)
+		}
+	}
+	return nil
+}
+
+// EndSession завершает WHIP/WHEP-сессию (DELETE): участник уходит из комнаты
+func EndSession(id, userID string) error {
+	u := lookupHTTPSession(id, userID)
+	if u == nil {
+		return ErrSessionNotFound
+	}
+	u.Close()
+	return nil
+}
+
+// lookupHTTPSession возвращает сессию id, если её открыл пользователь userID
+func lookupHTTPSession(id, userID string) *User {
+	httpSessionsMtx.Lock()
+	defer httpSessionsMtx.Unlock()
+	u := httpSessions[id]
+	if u == nil || u.account != userID {
+		return nil
+	}
+	return u
+}
+
+// forgetHTTPSession убирает закрытую сессию из httpSessions
+func forgetHTTPSession(u *User) {
+	if u.resource == "" {
+		return
+	}
+	httpSessionsMtx.Lock()
+	defer httpSessionsMtx.Unlock()
+	if httpSessions[u.resource] == u {
+		delete(httpSessions, u.resource)
+	}
+}
+
+// sdpAttr возвращает значение первого атрибута a=<name>: в SDP или sdpfrag
+func sdpAttr(sdp, name string) string {
+	prefix := "a=" + name + ":"
+	for _, line := range strings.Split(sdp, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), prefix); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// sessionID возвращает id участника комнаты для сессии пользователя userID
+func sessionID(userID string, kind sessionKind) string {
+	switch kind {
+	case sessionWHIP:
+		return userID + "/whip"
+	case sessionWHEP:
+		return userID + "/whep"
+	default:
+		return userID
+	}
+}
+
+func (k sessionKind) String() string {
+	switch k {
+	case sessionWHIP:
+		return "WHIP"
+	case sessionWHEP:
+		return "WHEP"
+	default:
+		return "WS"
+	}
+}
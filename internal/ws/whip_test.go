@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestSDPAttr(t *testing.T) {
+	sdp := "v=0\r\na=group:BUNDLE 0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=ice-ufrag:abcd\r\na=ice-pwd:secret\r\na=ice-ufrag:second\r\n"
+	if got := sdpAttr(sdp, "ice-ufrag"); got != "abcd" {
+		t.Errorf("ice-ufrag = %q, want first value abcd", got)
+	}
+	if got := sdpAttr(sdp, "ice-pwd"); got != "secret" {
+		t.Errorf("ice-pwd = %q, want secret", got)
+	}
+	if got := sdpAttr(sdp, "mid"); got != "" {
+		t.Errorf("missing attribute = %q, want empty", got)
+	}
+}
+
+// WHIP и WHEP — отдельные участники комнаты, не совпадающие с браузерной сессией того же пользователя
+func TestSessionID(t *testing.T) {
+	ids := map[string]bool{}
+	for _, kind := range []sessionKind{sessionWS, sessionWHIP, sessionWHEP} {
+		ids[sessionID("42", kind)] = true
+	}
+	if len(ids) != 3 {
+		t.Errorf("session ids collide: %v", ids)
+	}
+	if sessionID("42", sessionWS) != "42" {
+		t.Error("WebSocket participant id differs from user id")
+	}
+}
+
+// whipClient — PeerConnection издателя WHIP с одним Opus-треком и полным offer (все кандидаты в SDP)
+func whipClient(t *testing.T) (*webrtc.PeerConnection, webrtc.SessionDescription) {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "obs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc, *pc.LocalDescription()
+}
+
+// whipSession отвечает на offer издателя как WHIP-сессия "res" пользователя bob
+func whipSession(t *testing.T, offer string) (*User, string) {
+	t.Helper()
+	prev := api
+	a, err := newAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api = a
+	t.Cleanup(func() { api = prev })
+
+	u := NewUser(nil, nil)
+	u.kind = sessionWHIP
+	u.ID = sessionID("bob", sessionWHIP)
+	u.account = "bob"
+	u.resource = "res"
+	t.Cleanup(u.Close)
+	answer, err := u.answerHTTPOffer(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpSessionsMtx.Lock()
+	httpSessions[u.resource] = u
+	httpSessionsMtx.Unlock()
+	return u, answer
+}
+
+func TestWHIPAnswer(t *testing.T) {
+	client, offer := whipClient(t)
+	_, answer := whipSession(t, offer.SDP)
+
+	// trickle серверу некуда слать: все кандидаты уже в answer
+	if !strings.Contains(answer, "a=candidate:") {
+		t.Error("answer has no ICE candidates")
+	}
+	if !strings.Contains(answer, "a=recvonly") {
+		t.Error("server does not receive the published track")
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Errorf("client rejects answer: %v", err)
+	}
+}
+
+func TestWHIPTrickle(t *testing.T) {
+	_, offer := whipClient(t)
+	u, _ := whipSession(t, offer.SDP)
+	ufrag := sdpAttr(offer.SDP, "ice-ufrag")
+
+	frag := "a=ice-ufrag:" + ufrag + "\r\na=mid:0\r\na=candidate:1 1 udp 2130706431 10.0.0.1 5000 typ host\r\n"
+	if err := TrickleSession("res", "eve", frag); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("PATCH by another user: %v, want ErrSessionNotFound", err)
+	}
+	if err := TrickleSession("res", "bob", strings.Replace(frag, ufrag, "restart", 1)); !errors.Is(err, ErrICERestartUnsupported) {
+		t.Errorf("PATCH with new ufrag: %v, want ErrICERestartUnsupported", err)
+	}
+	if err := TrickleSession("res", "bob", frag); err != nil {
+		t.Errorf("PATCH with candidate: %v", err)
+	}
+	if len(u.pendingCandidates) != 0 {
+		t.Errorf("%d candidates left pending after remote description", len(u.pendingCandidates))
+	}
+
+	if err := EndSession("res", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := TrickleSession("res", "bob", frag); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("PATCH after DELETE: %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestWHIPInvalidOffer(t *testing.T) {
+	u := NewUser(nil, nil)
+	u.kind = sessionWHIP
+	defer u.Close()
+	if _, err := u.answerHTTPOffer("not sdp"); err == nil {
+		t.Error("garbage offer accepted")
+	}
+}
@@ -0,0 +1,113 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sendQueueSize — сколько исходящих сигнальных сообщений может ждать отправки у одного пользователя
+	sendQueueSize = 64
+	// writeWait — дедлайн на запись одного сообщения в WebSocket
+	writeWait = 10 * time.Second
+	// drainWait — сколько времени даём на дописывание очереди при закрытии пользователя
+	drainWait = time.Second
+)
+
+var (
+	// ErrUserClosed возвращается из Send, если пользователь уже закрыт
+	ErrUserClosed = errors.New("user closed")
+	// ErrSendQueueFull возвращается из Send, если клиент не успевает читать и очередь переполнена
+	ErrSendQueueFull = errors.New("send queue full")
+)
+
+// Send ставит сигнальное сообщение в исходящую очередь пользователя.
+// gorilla/websocket запрещает конкурентную запись в одно соединение, поэтому
+// все сообщения пишет только одна горутина WritePump.
+// Send не блокируется: если очередь переполнена, клиент считается медленным —
+// сообщение отбрасывается, а пользователь отключается, чтобы не оставлять его
+// с рассинхронизированным сигналингом (пропущенный offer или кандидат хуже разрыва).
+func (u *User) Send(msg SignalMessage) error {
+	// у WHIP/WHEP-участников сигналинга нет — сообщения им не доставляются
+	if u.kind != sessionWS {
+		return nil
+	}
+	select {
+	case <-u.done:
+		return ErrUserClosed
+	default:
+	}
+	// WebSocket оборван и ждёт resume — сообщение отбрасываем, при возобновлении
+	// клиент получит снимок комнаты (см. resume.go)
+	if u.isDetached() {
+		return nil
+	}
+
+	select {
+	case u.send <- msg:
+		return nil
+	case <-u.done:
+		return ErrUserClosed
+	default:
+		log.Printf("send queue full for user %s, disconnecting slow client\n", u.ID)
+		// Close может вызываться из обработчиков pion, поэтому закрываем асинхронно
+		go u.Close()
+		return ErrSendQueueFull
+	}
+}
+
+// WritePump — единственный писатель в WebSocket conn пользователя.
+// берёт сообщения из очереди send и пишет их с дедлайном writeWait.
+// раз в pingInterval шлёт клиенту ping (см. keepalive.go).
+// при ошибке записи отвязывает соединение (пользователь ждёт resume, см. resume.go);
+// stop закрывается, когда conn отвязан или заменён новым. при закрытии пользователя
+// дописывает остаток очереди (drainWait на всё), отправляет close-фрейм и закрывает соединение.
+func (u *User) WritePump(conn *websocket.Conn, stop <-chan struct{}) {
+	// WritePump владеет закрытием WebSocket — ReadPump разблокируется ошибкой чтения
+	defer conn.Close()
+
+	pings := time.NewTicker(pingInterval)
+	defer pings.Stop()
+
+	for {
+		select {
+		case <-pings.C:
+			if err := ping(conn); err != nil {
+				log.Println("ws ping:", err)
+				u.detach(conn)
+				return
+			}
+		case msg := <-u.send:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteJSON(msg); err != nil {
+				log.Println("ws write:", err)
+				u.detach(conn)
+				return
+			}
+		case <-stop:
+			return
+		case <-u.done:
+			u.drain(conn)
+			return
+		}
+	}
+}
+
+// drain дописывает сообщения, оставшиеся в очереди на момент закрытия, и отправляет close-фрейм
+func (u *User) drain(conn *websocket.Conn) {
+	_ = conn.SetWriteDeadline(time.Now().Add(drainWait))
+	for {
+		select {
+		case msg := <-u.send:
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		default:
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package ws
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// медленный клиент: переполнение очереди отбрасывает сообщение и закрывает пользователя
+func TestSendQueueOverflowClosesUser(t *testing.T) {
+	u := NewUser(nil, nil)
+	for i := 0; i < sendQueueSize; i++ {
+		if err := u.Send(SignalMessage{Type: TypeSpeaking, ID: strconv.Itoa(i)}); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if err := u.Send(SignalMessage{Type: TypeSpeaking}); !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("send to full queue: %v, want ErrSendQueueFull", err)
+	}
+
+	select {
+	case <-u.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("user not closed after queue overflow")
+	}
+	if err := u.Send(SignalMessage{Type: TypeSpeaking}); !errors.Is(err, ErrUserClosed) {
+		t.Errorf("send after close: %v, want ErrUserClosed", err)
+	}
+}
+
+// при закрытии WritePump дописывает очередь и отправляет close-фрейм
+func TestWritePumpDrainsOnClose(t *testing.T) {
+	conn, client := wsPair(t)
+	u := NewUser(conn, nil)
+	for i := 0; i < 3; i++ {
+		if err := u.Send(SignalMessage{Type: TypeSpeaking, ID: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u.Close()
+	go u.WritePump(conn, u.connDone)
+
+	for i := 0; i < 3; i++ {
+		if msg := readSignal(t, client); msg.ID != strconv.Itoa(i) {
+			t.Fatalf("message %d: id %q, want %d", i, msg.ID, i)
+		}
+	}
+	if _, _, err := client.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("after drain: %v, want normal close", err)
+	}
+}